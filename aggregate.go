@@ -0,0 +1,66 @@
+package gockpit
+
+import "math"
+
+// Aggregation is a function of numeric values sampled within a persist window.
+type Aggregation string
+
+const (
+	AggregateMin Aggregation = "min"
+	AggregateMax Aggregation = "max"
+	AggregateAvg Aggregation = "avg"
+)
+
+type aggregate struct {
+	min, max, sum float64
+	count         int
+}
+
+func (a *aggregate) add(val float64) {
+	if a.count == 0 {
+		a.min, a.max = val, val
+	}
+	a.min = math.Min(a.min, val)
+	a.max = math.Max(a.max, val)
+	a.sum += val
+	a.count++
+}
+
+func (a *aggregate) value(agg Aggregation) float64 {
+	switch agg {
+	case AggregateMin:
+		return a.min
+	case AggregateMax:
+		return a.max
+	default:
+		return a.sum / float64(a.count)
+	}
+}
+
+// persistWindow aggregates numeric values of the state between saves
+type persistWindow map[string]*aggregate
+
+// add records numeric values of data
+func (w persistWindow) add(data map[string]interface{}) {
+	for key, val := range data {
+		f, ok := toFloat64(val)
+		if !ok {
+			continue
+		}
+		a, found := w[key]
+		if !found {
+			a = &aggregate{}
+			w[key] = a
+		}
+		a.add(f)
+	}
+}
+
+// fields adds aggregated values to fields as <key>.<aggregation>
+func (w persistWindow) fields(fields map[string]interface{}, aggs []Aggregation) {
+	for key, a := range w {
+		for _, agg := range aggs {
+			fields[key+"."+string(agg)] = a.value(agg)
+		}
+	}
+}
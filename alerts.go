@@ -1,6 +1,18 @@
 package gockpit
 
-import "time"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
 
 type AlertStrategy func(*Alert) bool
 
@@ -11,17 +23,261 @@ type Alert struct {
 	IsSet          bool      `json:"isSet"`
 	FirstOccurence time.Time `json:"firstOccurrence"`
 	LastOccurrence time.Time `json:"lastOccurrence"`
-	update         func(interface{}, *Alert)
+	// Unknown is set when the alert could not be evaluated because its metric holds an unexpected value
+	Unknown   bool `json:"unknown,omitempty"`
+	operator  string
+	threshold interface{}
+	// hysteresis is the band past the threshold a value has to cross for the alert to clear
+	hysteresis float64
+	// key of the watched metric; alert ID is used if empty
+	key     string
+	id      string
+	message string
+	// severity, runbook and labels describe the alert to downstream alerting systems
+	severity Severity
+	runbook  string
+	labels   map[string]string
+	// acked suppresses notifications until the alert clears
+	acked bool
+	// notifications are suppressed until silencedUntil
+	silencedUntil time.Time
+	// cooldown is the minimum time between notifications
+	cooldown time.Duration
+	// lastNotified and notifiedSet tell when and which status has been notified last
+	lastNotified time.Time
+	notifiedSet  bool
+	// pending is set when a transition has been postponed by the cooldown
+	pending bool
+	// expr is set for alerts evaluated against the whole state
+	expr   func(*State) bool
+	update func(interface{}, *Alert)
+	// clock is the one of the supervisor the alert is registered with
+	clock Clock
+}
+
+type alertJSON struct {
+	ID             string            `json:"id,omitempty"`
+	Metric         string            `json:"metric"`
+	Active         bool              `json:"active"`
+	IsSet          bool              `json:"isSet"`
+	Unknown        bool              `json:"unknown,omitempty"`
+	FirstOccurence time.Time         `json:"firstOccurrence"`
+	LastOccurrence time.Time         `json:"lastOccurrence"`
+	Message        string            `json:"message"`
+	Severity       Severity          `json:"severity"`
+	RunbookURL     string            `json:"runbookUrl,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	Acked          bool              `json:"acked,omitempty"`
+	SilencedUntil  *time.Time        `json:"silencedUntil,omitempty"`
+}
+
+func (a *Alert) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.json(a.id, a.now()))
+}
+
+// now returns the time of the supervisor clock; system time is used for unregistered alerts
+func (a *Alert) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+	return a.clock.Now()
+}
+
+func (a *Alert) json(id string, now time.Time) alertJSON {
+	return alertJSON{
+		ID:             id,
+		Metric:         a.metric(id),
+		Active:         a.IsSet,
+		IsSet:          a.IsSet,
+		Unknown:        a.Unknown,
+		FirstOccurence: a.FirstOccurence,
+		LastOccurrence: a.LastOccurrence,
+		Message:        a.describe(id),
+		Severity:       a.severity,
+		RunbookURL:     a.runbook,
+		Labels:         a.labels,
+		Acked:          a.acked,
+		SilencedUntil:  a.silence(now),
+	}
+}
+
+// silence returns the end of the silence or nil if the alert is not silenced at now
+func (a *Alert) silence(now time.Time) *time.Time {
+	if a.silencedUntil.IsZero() || !now.Before(a.silencedUntil) {
+		return nil
+	}
+	until := a.silencedUntil
+	return &until
+}
+
+// silenced tells if notifications of the alert are suppressed
+func (a *Alert) silenced(now time.Time) bool {
+	return a.acked || now.Before(a.silencedUntil)
+}
+
+// shouldNotify tells if the notifier should be told the status of the alert after its evaluation.
+// Transitions within the cooldown are postponed and only the final status is notified once it ends.
+func (a *Alert) shouldNotify(changed bool, now time.Time) bool {
+	if !changed && !a.pending {
+		return false
+	}
+	silenced := a.silenced(now)
+	if changed && !a.IsSet {
+		// acknowledgement lasts until the alert clears
+		a.acked = false
+	}
+	if silenced {
+		// the status is regarded as notified so that the next transition is
+		a.pending = false
+		a.notifiedSet = a.IsSet
+		return false
+	}
+	if now.Before(a.lastNotified.Add(a.cooldown)) {
+		a.pending = true
+		return false
+	}
+	a.pending = false
+	if a.IsSet == a.notifiedSet {
+		// the alert flapped back to the notified status within the cooldown
+		return false
+	}
+	a.lastNotified = now
+	a.notifiedSet = a.IsSet
+	return true
+}
+
+// alert restores the status of an alert rendered to JSON
+func (j alertJSON) alert(id string) *Alert {
+	a := &Alert{
+		IsSet:          j.IsSet,
+		Unknown:        j.Unknown,
+		FirstOccurence: j.FirstOccurence,
+		LastOccurrence: j.LastOccurrence,
+		id:             id,
+		message:        j.Message,
+		severity:       j.Severity,
+		runbook:        j.RunbookURL,
+		labels:         j.Labels,
+		acked:          j.Acked,
+	}
+	if j.SilencedUntil != nil {
+		a.silencedUntil = *j.SilencedUntil
+	}
+	if j.Metric != id {
+		a.key = j.Metric
+	}
+	return a
+}
+
+// Message returns a human readable description of the alert condition.
+func (a *Alert) Message() string {
+	return a.describe(a.id)
+}
+
+func (a *Alert) describe(id string) string {
+	if a.message != "" {
+		return a.message
+	}
+	if a.expr != nil {
+		return fmt.Sprintf("%s expression", id)
+	}
+	return fmt.Sprintf("%s %s %v", a.metric(id), a.operator, a.threshold)
+}
+
+// AlertInfo is a read-only description of a registered alert.
+type AlertInfo struct {
+	ID         string      `json:"id"`
+	Metric     string      `json:"metric"`
+	Operator   string      `json:"operator"`
+	Threshold  interface{} `json:"threshold"`
+	Hysteresis float64     `json:"hysteresis,omitempty"`
+	IsSet      bool        `json:"isSet"`
+	Unknown    bool        `json:"unknown,omitempty"`
+	Since      time.Time   `json:"since"`
+	Acked      bool        `json:"acked,omitempty"`
+	// SilencedUntil is set while notifications of the alert are silenced
+	SilencedUntil *time.Time        `json:"silencedUntil,omitempty"`
+	Severity      Severity          `json:"severity"`
+	RunbookURL    string            `json:"runbookUrl,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
 }
 
 func (a *Alert) Clear() {
 	a.IsSet = false
 }
 
+// reset clears the status of the alert keeping its configuration, e.g. once its metric is deleted
+func (a *Alert) reset() {
+	a.IsSet = false
+	a.Unknown = false
+	a.acked = false
+	a.silencedUntil = time.Time{}
+	a.pending = false
+	a.notifiedSet = false
+}
+
 type Alerts map[string]*Alert
 
-func NewBoolAlert(strategy AlertStrategy) *Alert {
-	return &Alert{
+func (a Alerts) MarshalJSON() ([]byte, error) {
+	alerts := make(map[string]alertJSON, len(a))
+	for id, alert := range a {
+		alerts[id] = alert.json(id, alert.now())
+	}
+	return json.Marshal(alerts)
+}
+
+func (a *Alert) info(id string, now time.Time) AlertInfo {
+	info := AlertInfo{
+		ID:         id,
+		Metric:     a.metric(id),
+		Operator:   a.operator,
+		Threshold:  a.threshold,
+		Hysteresis: a.hysteresis,
+		IsSet:      a.IsSet,
+		Unknown:    a.Unknown,
+		Acked:      a.acked,
+		Severity:   a.severity,
+		RunbookURL: a.runbook,
+		Labels:     a.labels,
+	}
+	info.SilencedUntil = a.silence(now)
+	if a.IsSet {
+		info.Since = a.FirstOccurence
+	}
+	return info
+}
+
+// metric returns the key of the watched metric
+func (a *Alert) metric(id string) string {
+	if a.key != "" {
+		return a.key
+	}
+	return id
+}
+
+// evaluate updates the alert with the current value of its metric and keeps track of occurrences.
+// It returns true if the alert has been set or cleared.
+func (a *Alert) evaluate(val interface{}, now time.Time) bool {
+	if a.update == nil {
+		// alerts restored from JSON only carry their status
+		return false
+	}
+	wasSet := a.IsSet
+	a.update(val, a)
+	if !a.IsSet {
+		return wasSet
+	}
+	if !wasSet {
+		a.FirstOccurence = now
+	}
+	a.LastOccurrence = now
+	return !wasSet
+}
+
+func NewBoolAlert(strategy AlertStrategy, opts ...AlertOption) *Alert {
+	alert := &Alert{
+		operator:  "==",
+		threshold: true,
 		update: func(i interface{}, a *Alert) {
 			b, ok := i.(bool)
 			if !ok {
@@ -36,10 +292,16 @@ func NewBoolAlert(strategy AlertStrategy) *Alert {
 			}
 		},
 	}
+	for _, o := range opts {
+		o(alert)
+	}
+	return alert
 }
 
-func NewInverseBoolAlert(strategy AlertStrategy) *Alert {
-	return &Alert{
+func NewInverseBoolAlert(strategy AlertStrategy, opts ...AlertOption) *Alert {
+	alert := &Alert{
+		operator:  "==",
+		threshold: false,
 		update: func(i interface{}, a *Alert) {
 			b, ok := i.(bool)
 			if !ok {
@@ -54,27 +316,262 @@ func NewInverseBoolAlert(strategy AlertStrategy) *Alert {
 			}
 		},
 	}
+	for _, o := range opts {
+		o(alert)
+	}
+	return alert
 }
 
-func NewMaxFloatAlert(max float64, strategy AlertStrategy) *Alert {
-	return &Alert{
+func NewMaxFloatAlert(max float64, strategy AlertStrategy, opts ...AlertOption) *Alert {
+	alert := &Alert{
+		operator:  ">=",
+		threshold: max,
 		update: func(i interface{}, a *Alert) {
-			switch val := i.(type) {
+			var val float64
+			switch v := i.(type) {
 			case float32:
-				if float64(val) >= max {
-					a.IsSet = true
-					return
-				}
+				val = float64(v)
 			case float64:
-				if val >= max {
-					a.IsSet = true
-				}
+				val = v
 			default:
 				return
 			}
+			if val >= max {
+				a.IsSet = true
+				return
+			}
+			if a.IsSet && OpGreaterOrEqual.holds(val, max, a.hysteresis) {
+				return
+			}
 			if strategy(a) {
 				a.IsSet = false
 			}
 		},
 	}
+	for _, o := range opts {
+		o(alert)
+	}
+	return alert
+}
+
+// AlertNotifier is called when an alert gets set (active is true) or cleared.
+// It is called with the state lock held so it must not block.
+type AlertNotifier func(id string, a *Alert, active bool)
+
+type alertEvent struct {
+	AlertInfo
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+	DedupKey string    `json:"dedupKey"`
+}
+
+// dedupKey identifies the alert together with its labels, e.g. temp{host=a}, so that alerts
+// of several supervisors sharing the same receiver are told apart
+func (a *Alert) dedupKey(id string) string {
+	if len(a.labels) == 0 {
+		return id
+	}
+	names := make([]string, 0, len(a.labels))
+	for name := range a.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + a.labels[name]
+	}
+	return id + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WebhookOption configures WebhookNotifier.
+type WebhookOption func(*webhookConfig)
+
+type webhookConfig struct {
+	logger *zerolog.Logger
+}
+
+// WithWebhookLogger makes the notifier log failed notifications with logger, e.g. the one passed
+// to WithLogger, instead of the global zerolog logger.
+func WithWebhookLogger(logger *zerolog.Logger) WebhookOption {
+	return func(c *webhookConfig) {
+		c.logger = logger
+	}
+}
+
+// WebhookNotifier returns an AlertNotifier posting alert transitions as JSON to url.
+// The payload carries a text field so that it may be consumed by Slack incoming webhooks,
+// together with the severity, runbook URL, labels and a deduplication key of the alert.
+func WebhookNotifier(url string, opts ...WebhookOption) AlertNotifier {
+	config := webhookConfig{logger: &log.Logger}
+	for _, o := range opts {
+		o(&config)
+	}
+	logger := config.logger
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(id string, a *Alert, active bool) {
+		now := a.now()
+		event := alertEvent{AlertInfo: a.info(id, now), Time: now, DedupKey: a.dedupKey(id)}
+		if active {
+			event.Text = fmt.Sprintf("alert %s is active: %s %s %v", id, event.Metric, event.Operator, event.Threshold)
+		} else {
+			event.Text = fmt.Sprintf("alert %s has been cleared", id)
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			logger.Error().Err(err).Str("alert", id).Msg("could not encode alert notification")
+			return
+		}
+		go func() {
+			res, err := client.Post(url, JSONContentType, bytes.NewReader(payload))
+			if err != nil {
+				logger.Error().Err(err).Str("alert", id).Msg("could not send alert notification")
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode/100 != 2 {
+				logger.Error().Int("status", res.StatusCode).Str("alert", id).Msg("alert notification rejected")
+			}
+		}()
+	}
+}
+
+type ComparisonOp string
+
+const (
+	OpGreater        ComparisonOp = ">"
+	OpGreaterOrEqual ComparisonOp = ">="
+	OpLess           ComparisonOp = "<"
+	OpLessOrEqual    ComparisonOp = "<="
+	OpEqual          ComparisonOp = "=="
+)
+
+func (op ComparisonOp) compare(val, threshold float64) bool {
+	switch op {
+	case OpGreater:
+		return val > threshold
+	case OpGreaterOrEqual:
+		return val >= threshold
+	case OpLess:
+		return val < threshold
+	case OpLessOrEqual:
+		return val <= threshold
+	case OpEqual:
+		return val == threshold
+	default:
+		panic(fmt.Sprintf("unsupported comparison operator %q", string(op)))
+	}
+}
+
+// holds tells if an active alert should stay active. The value has to move past the threshold
+// by more than band in the clearing direction for the alert to clear.
+func (op ComparisonOp) holds(val, threshold, band float64) bool {
+	switch op {
+	case OpGreater, OpGreaterOrEqual:
+		return op.compare(val, threshold-band)
+	case OpLess, OpLessOrEqual:
+		return op.compare(val, threshold+band)
+	default:
+		return math.Abs(val-threshold) <= band
+	}
+}
+
+type AlertOption func(*Alert)
+
+// WithMessage sets a human readable alert message.
+func WithMessage(msg string) AlertOption {
+	return func(a *Alert) {
+		a.message = msg
+	}
+}
+
+// WithSeverity sets the severity of the alert; alerts are of SeverityError by default.
+func WithSeverity(severity Severity) AlertOption {
+	return func(a *Alert) {
+		a.severity = severity
+	}
+}
+
+// WithRunbookURL links the alert to the runbook describing how to handle it.
+func WithRunbookURL(url string) AlertOption {
+	return func(a *Alert) {
+		a.runbook = url
+	}
+}
+
+// WithLabels attaches labels to the alert that downstream systems may route alerts by.
+func WithLabels(labels map[string]string) AlertOption {
+	return func(a *Alert) {
+		a.labels = make(map[string]string, len(labels))
+		for name, value := range labels {
+			a.labels[name] = value
+		}
+	}
+}
+
+// WithCooldown limits notifications of the alert to one per cooldown. Transitions within
+// the cooldown are not notified; the notifier is told the final status on the first evaluation
+// after the cooldown ends unless it matches the one notified last.
+func WithCooldown(cooldown time.Duration) AlertOption {
+	return func(a *Alert) {
+		a.cooldown = cooldown
+	}
+}
+
+// WithHysteresis makes an active threshold or max float alert clear only once its value moves
+// past the threshold by more than band, e.g. below T-band for > and >= alerts.
+func WithHysteresis(band float64) AlertOption {
+	return func(a *Alert) {
+		a.hysteresis = math.Abs(band)
+	}
+}
+
+// NewThresholdAlert creates an alert set when the numeric value of key compared with threshold using op holds.
+// The alert is marked as unknown and keeps its previous state while key holds a non numeric value.
+func NewThresholdAlert(key string, op ComparisonOp, threshold float64, strategy AlertStrategy, opts ...AlertOption) *Alert {
+	// fail at registration rather than during evaluation
+	op.compare(0, threshold)
+	alert := &Alert{
+		operator:  string(op),
+		threshold: threshold,
+		key:       key,
+		update: func(i interface{}, a *Alert) {
+			val, ok := toFloat64(i)
+			a.Unknown = !ok
+			if !ok {
+				return
+			}
+			if op.compare(val, threshold) {
+				a.IsSet = true
+				return
+			}
+			if a.IsSet && op.holds(val, threshold, a.hysteresis) {
+				return
+			}
+			if strategy(a) {
+				a.IsSet = false
+			}
+		},
+	}
+	for _, o := range opts {
+		o(alert)
+	}
+	return alert
+}
+
+// NewExprAlert creates an alert set while fn holds for the state. It allows conditions spanning
+// multiple keys, e.g. high error rate under significant load. fn is called on every state change
+// and receives a read-only view of the state that must not be retained, so it should be cheap.
+// The view does not hold alerts and is not guarded by the state lock (which is held by the caller).
+func NewExprAlert(fn func(*State) bool, opts ...AlertOption) *Alert {
+	alert := &Alert{
+		operator: "expr",
+		expr:     fn,
+		update: func(i interface{}, a *Alert) {
+			a.IsSet = a.expr(i.(*State))
+		},
+	}
+	for _, o := range opts {
+		o(alert)
+	}
+	return alert
 }
@@ -0,0 +1,46 @@
+package gockpit
+
+import "time"
+
+// Clock is the source of time driving sampling. It may be replaced in tests with WithClock
+// to advance time manually.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls f in its own goroutine once d elapses.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Ticker delivers ticks of a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is a call scheduled with AfterFunc of a Clock.
+type Timer interface {
+	// Stop prevents the call; it returns false if the call has already happened or been stopped.
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
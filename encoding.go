@@ -0,0 +1,178 @@
+package gockpit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	YAMLContentType    = "application/yaml"
+	MsgpackContentType = "application/msgpack"
+	CSVContentType     = "text/csv"
+)
+
+// gzipMinSize is the size below which responses are not worth compressing
+const gzipMinSize = 1024
+
+var ErrNotAcceptable = errors.New("none of the accepted content types is supported")
+
+type encoder func(interface{}) ([]byte, error)
+
+var encoders = map[string]encoder{
+	JSONContentType:         json.Marshal,
+	YAMLContentType:         encodeYAML,
+	"application/x-yaml":    encodeYAML,
+	"text/yaml":             encodeYAML,
+	MsgpackContentType:      encodeMsgpack,
+	"application/x-msgpack": encodeMsgpack,
+}
+
+// negotiate picks the content type and encoder matching the Accept header the best.
+// JSON is used when the header is empty or accepts any type.
+func negotiate(accept string) (string, encoder, error) {
+	if accept == "" {
+		return JSONContentType, json.Marshal, nil
+	}
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if val, found := params["q"]; found {
+			if q, err = strconv.ParseFloat(val, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	for _, r := range ranges {
+		if r.q <= 0 {
+			continue
+		}
+		if r.mediaType == "*/*" || r.mediaType == "application/*" {
+			return JSONContentType, json.Marshal, nil
+		}
+		if enc, found := encoders[r.mediaType]; found {
+			return r.mediaType, enc, nil
+		}
+	}
+	return "", nil, ErrNotAcceptable
+}
+
+// encodeYAML renders the JSON representation of val as YAML so that both formats share the same layout
+func encodeYAML(val interface{}) ([]byte, error) {
+	generic, err := toGeneric(val)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+// encodeMsgpack renders the JSON representation of val as msgpack with sorted map keys
+func encodeMsgpack(val interface{}) ([]byte, error) {
+	generic, err := toGeneric(val)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = msgpack.NewEncoder(&buf).SortMapKeys(true).Encode(generic)
+	return buf.Bytes(), err
+}
+
+// toGeneric converts val into maps, slices and scalars following its JSON representation.
+// Integral numbers are kept as int64.
+func toGeneric(val interface{}) (interface{}, error) {
+	js, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return normalizeNumbers(generic), nil
+}
+
+func normalizeNumbers(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = normalizeNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalizeNumbers(elem)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return val
+}
+
+// acceptsGzip tells if the Accept-Encoding header allows gzip encoded responses.
+func acceptsGzip(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err != nil {
+				continue
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// etagMatches weakly compares etag with the tags listed in the If-None-Match header.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
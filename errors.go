@@ -2,28 +2,64 @@ package gockpit
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 	"strings"
 	"time"
 )
 
+// Error is an unresolved error together with its occurrence history.
 type Error struct {
-	Err          error
-	Count        int
-	LastOccurred time.Time
+	Err error
+	// Count is the number of times the error has been reported since it first appeared
+	Count     int
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Severity  Severity
+	// collected errors were reported with Supervisor.CollectError; probes do not overwrite nor clear them
+	collected bool
+}
+
+type errorJSON struct {
+	Error     string    `json:"error"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Severity  Severity  `json:"severity"`
+	Chain     []string  `json:"chain,omitempty"`
+	Stack     string    `json:"stack,omitempty"`
 }
 
 func (e Error) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Error        string    `json:"error"`
-		Count        int       `json:"count"`
-		LastOccurred time.Time `json:"lastOccur"`
-	}{e.Err.Error(), e.Count, e.LastOccurred})
+	return json.Marshal(e.json())
+}
+
+func (e Error) json() errorJSON {
+	return errorJSON{Error: e.Err.Error(), Count: e.Count, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen, Severity: e.Severity}
+}
+
+// verbose renders the error together with its unwrap chain and the stack trace
+// if the error formats one with the %+v verb (e.g. github.com/pkg/errors).
+func (e Error) verbose() errorJSON {
+	v := e.json()
+	for err := errors.Unwrap(e.Err); err != nil; err = errors.Unwrap(err) {
+		v.Chain = append(v.Chain, err.Error())
+	}
+	if _, ok := e.Err.(fmt.Formatter); ok {
+		v.Stack = fmt.Sprintf("%+v", e.Err)
+	}
+	return v
 }
 
 func (e Error) Error() string {
 	return e.Err.Error()
 }
 
+func (e Error) Unwrap() error {
+	return e.Err
+}
+
 type Errors map[string]Error
 
 func (e Errors) Error() string {
@@ -35,14 +71,142 @@ func (e Errors) Error() string {
 	return build.String()
 }
 
+func (e Errors) json() map[string]errorJSON {
+	v := make(map[string]errorJSON, len(e))
+	for code, err := range e {
+		v[code] = err.json()
+	}
+	return v
+}
+
+func (e Errors) verbose() map[string]errorJSON {
+	v := make(map[string]errorJSON, len(e))
+	for code, err := range e {
+		v[code] = err.verbose()
+	}
+	return v
+}
+
+// Len returns the number of errors.
+func (e Errors) Len() int {
+	return len(e)
+}
+
+// Codes returns sorted codes of the errors.
+func (e Errors) Codes() []string {
+	codes := make([]string, 0, len(e))
+	for code := range e {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Filter returns errors for which pred returns true.
+func (e Errors) Filter(pred func(code string, err Error) bool) Errors {
+	filtered := make(Errors)
+	for code, err := range e {
+		if pred(code, err) {
+			filtered[code] = err
+		}
+	}
+	return filtered
+}
+
+// Merge adds other errors to e. Occurrences of errors present in both are summed up;
+// the error and its severity are taken from the one seen last.
+func (e Errors) Merge(other Errors) {
+	for code, err := range other {
+		existing, ok := e[code]
+		if !ok {
+			e[code] = err
+			continue
+		}
+		if err.LastSeen.After(existing.LastSeen) {
+			existing.Err = err.Err
+			existing.Severity = err.Severity
+			existing.LastSeen = err.LastSeen
+		}
+		if err.FirstSeen.Before(existing.FirstSeen) {
+			existing.FirstSeen = err.FirstSeen
+		}
+		existing.Count += err.Count
+		existing.collected = existing.collected || err.collected
+		e[code] = existing
+	}
+}
+
+// Collect records an occurrence of the error identified by code.
 func (e Errors) Collect(code string, err error) {
+	e.CollectLevel(code, SeverityError, err)
+}
+
+// CollectLevel records an occurrence of the error identified by code with the given severity.
+// The severity of the latest occurrence is kept.
+func (e Errors) CollectLevel(code string, severity Severity, err error) {
+	e.collectAt(code, severity, err, time.Now())
+}
+
+func (e Errors) collectAt(code string, severity Severity, err error, now time.Time) {
 	existing, ok := e[code]
 	if !ok {
-		e[code] = Error{Err: err, Count: 1, LastOccurred: time.Now()}
+		e[code] = Error{Err: err, Count: 1, FirstSeen: now, LastSeen: now, Severity: severity}
 		return
 	}
 	existing.Count++
-	existing.LastOccurred = time.Now()
+	existing.LastSeen = now
 	existing.Err = err // set to latest occurrence as several errors may share the same id
+	existing.Severity = severity
 	e[code] = existing
 }
+
+// Severity tells how serious an error is. Errors are of SeverityError unless reported otherwise.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota - 2
+	SeverityWarn
+	SeverityError
+	SeverityCritical
+)
+
+var severityNames = map[Severity]string{
+	SeverityInfo:     "info",
+	SeverityWarn:     "warn",
+	SeverityError:    "error",
+	SeverityCritical: "critical",
+}
+
+func (s Severity) String() string {
+	if name, found := severityNames[s]; found {
+		return name
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+func (s Severity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *Severity) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	parsed, err := ParseSeverity(name)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// ParseSeverity returns the severity of the given name: info, warn, error or critical.
+func ParseSeverity(name string) (Severity, error) {
+	for s, n := range severityNames {
+		if strings.EqualFold(n, name) {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown severity %q", name)
+}
@@ -1,12 +1,33 @@
 module github.com/mklimuk/gockpit
 
-go 1.13
+go 1.20
 
 require (
 	github.com/go-chi/chi v4.0.3+incompatible
 	github.com/influxdata/influxdb-client-go v0.1.5
+	github.com/prometheus/client_golang v1.20.5
+	github.com/prometheus/client_model v0.6.1
+	github.com/prometheus/common v0.55.0
 	github.com/rs/zerolog v1.18.0
 	github.com/spf13/afero v1.2.2
-	github.com/stretchr/testify v1.4.0
-	nhooyr.io/websocket v1.8.6
+	github.com/stretchr/testify v1.9.0
+	github.com/vmihailenco/msgpack v4.0.4+incompatible
+	gopkg.in/yaml.v2 v2.4.0
+	nhooyr.io/websocket v1.8.17
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/influxdata/line-protocol v0.0.0-20190509173118-5712a8124a9a // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	github.com/stretchr/objx v0.5.2 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
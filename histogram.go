@@ -0,0 +1,124 @@
+package gockpit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// histogramSamples bounds the reservoir of observations percentiles are estimated from
+	histogramSamples       = 1024
+	defaultHistogramWindow = time.Minute
+)
+
+// Quantiles rendered by Histogram in JSON and Prometheus output.
+var Quantiles = []float64{0.5, 0.95, 0.99}
+
+// Histogram is a state value summarizing observations fed with StateMutation.Observe, e.g. latencies.
+// Percentiles are estimated from a uniform sample of observations made within the current window;
+// the histogram starts over once the window elapses so that it reflects recent behaviour.
+// Histograms held by the state are never modified; observations produce a new value.
+type Histogram struct {
+	start   time.Time
+	count   uint64
+	sum     float64
+	samples []float64
+}
+
+// observe returns a copy of h with values added; the window starts over if it has elapsed
+func (h Histogram) observe(now time.Time, window time.Duration, values []float64) Histogram {
+	next := Histogram{start: h.start, count: h.count, sum: h.sum}
+	if h.start.IsZero() || !now.Before(h.start.Add(window)) {
+		next = Histogram{start: now}
+	} else {
+		next.samples = make([]float64, len(h.samples), histogramSamples)
+		copy(next.samples, h.samples)
+	}
+	for _, val := range values {
+		next.count++
+		next.sum += val
+		// reservoir sampling keeps every observation with the same probability
+		if len(next.samples) < histogramSamples {
+			next.samples = append(next.samples, val)
+		} else if i := rand.Int63n(int64(next.count)); i < histogramSamples {
+			next.samples[i] = val
+		}
+	}
+	return next
+}
+
+// Count returns the number of observations made within the window.
+func (h Histogram) Count() uint64 {
+	return h.count
+}
+
+// Sum returns the sum of observations made within the window.
+func (h Histogram) Sum() float64 {
+	return h.sum
+}
+
+// Quantile returns the estimated q-quantile (0-1) of observations. It is NaN if there are none.
+func (h Histogram) Quantile(q float64) float64 {
+	if len(h.samples) == 0 {
+		return math.NaN()
+	}
+	sorted := make([]float64, len(h.samples))
+	copy(sorted, h.samples)
+	sort.Float64s(sorted)
+	return quantile(sorted, q)
+}
+
+// quantile interpolates linearly between the closest ranks of sorted values
+func quantile(sorted []float64, q float64) float64 {
+	q = math.Min(math.Max(q, 0), 1)
+	pos := q * float64(len(sorted)-1)
+	lower := int(pos)
+	if lower == len(sorted)-1 {
+		return sorted[lower]
+	}
+	return sorted[lower] + (sorted[lower+1]-sorted[lower])*(pos-float64(lower))
+}
+
+// quantiles returns estimates of Quantiles
+func (h Histogram) quantiles() []float64 {
+	if len(h.samples) == 0 {
+		return nil
+	}
+	sorted := make([]float64, len(h.samples))
+	copy(sorted, h.samples)
+	sort.Float64s(sorted)
+	values := make([]float64, len(Quantiles))
+	for i, q := range Quantiles {
+		values[i] = quantile(sorted, q)
+	}
+	return values
+}
+
+// fields flattens the histogram into <key>.count, <key>.sum and <key>.p<percentile> values
+func (h Histogram) fields(key string) map[string]interface{} {
+	fields := map[string]interface{}{key + ".count": int(h.count), key + ".sum": h.sum}
+	for i, val := range h.quantiles() {
+		fields[key+"."+percentileName(Quantiles[i])] = val
+	}
+	return fields
+}
+
+func percentileName(q float64) string {
+	return fmt.Sprintf("p%g", q*100)
+}
+
+func (h Histogram) MarshalJSON() ([]byte, error) {
+	out := map[string]interface{}{"count": h.count, "sum": h.sum}
+	for i, val := range h.quantiles() {
+		out[percentileName(Quantiles[i])] = val
+	}
+	return json.Marshal(out)
+}
+
+func (h Histogram) String() string {
+	return fmt.Sprintf("count=%d sum=%g", h.count, h.sum)
+}
@@ -0,0 +1,72 @@
+package gockpit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateMutation_Observe(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddProbe("latency", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		for i := 1; i <= 100; i++ {
+			m.Observe("latency", float64(i))
+		}
+	}))
+	st := sup.SampleNow(context.Background())
+	h, err := st.GetHistogram("latency")
+	require.NoError(t, err)
+	assert.EqualValues(t, 100, h.Count())
+	assert.Equal(t, 5050.0, h.Sum())
+	assert.InDelta(t, 50.5, st.Percentile("latency", 0.5), 0.001)
+	assert.InDelta(t, 99.01, st.Percentile("latency", 0.99), 0.001)
+
+	data, err := json.Marshal(st)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"latency":{"count":100,"p50":50.5,"p95":95.05,"p99":99.01,"sum":5050}`)
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(sup.prometheusText()))
+	require.NoError(t, err)
+	require.Contains(t, families, "gockpit_test_latency")
+	summary := families["gockpit_test_latency"].Metric[0].GetSummary()
+	assert.EqualValues(t, 100, summary.GetSampleCount())
+	assert.Len(t, summary.GetQuantile(), 3)
+
+	assert.Equal(t, map[string]interface{}{"latency.count": 100, "latency.sum": 5050.0, "latency.p50": 50.5, "latency.p95": 95.05, "latency.p99": 99.01}, sup.persistedFields())
+}
+
+func TestHistogram_Window(t *testing.T) {
+	now := time.Now()
+	h := Histogram{}.observe(now, time.Minute, []float64{1, 2, 3})
+	h = h.observe(now.Add(30*time.Second), time.Minute, []float64{4})
+	assert.EqualValues(t, 4, h.Count())
+	previous := h
+	h = h.observe(now.Add(time.Minute), time.Minute, []float64{10})
+	assert.EqualValues(t, 1, h.Count(), "histogram starts over once the window elapses")
+	assert.Equal(t, 10.0, h.Quantile(0.5))
+	assert.EqualValues(t, 4, previous.Count(), "observations do not modify the histogram")
+	assert.True(t, math.IsNaN(Histogram{}.Quantile(0.5)))
+
+	for i := 0; i < 3*histogramSamples; i++ {
+		h = h.observe(now.Add(time.Minute), time.Minute, []float64{float64(i % 100)})
+	}
+	assert.Len(t, h.samples, histogramSamples)
+	assert.InDelta(t, 50, h.Quantile(0.5), 10)
+}
+
+func TestStateMutation_ObserveMismatch(t *testing.T) {
+	s := &State{}
+	s.With().Set("latency", "fast").Apply()
+	s.With().Observe("latency", 1).Apply()
+	assert.ErrorIs(t, s.Err("latency"), ErrTypeMismatch)
+	_, err := s.GetHistogram("latency")
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+}
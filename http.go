@@ -7,8 +7,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/rs/zerolog/log"
-
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
@@ -70,7 +68,7 @@ func (pub *EventPublisher) EventsHandler() http.HandlerFunc {
 		if prev != nil {
 			err = prev.ws.Close(websocket.StatusGoingAway, "received another connection from peer")
 			if err != nil {
-				log.Warn().Err(err).Str("peer", r.RemoteAddr).Msg("could not close previous connection from peer")
+				pub.sup.logger.Warn().Err(err).Str("peer", r.RemoteAddr).Msg("could not close previous connection from peer")
 			}
 		}
 		conn := NewConn(r.RemoteAddr, ws)
@@ -112,16 +110,16 @@ func (pub *EventPublisher) writeState(ctx context.Context, peer string, state *S
 	if err != nil {
 		status := websocket.CloseStatus(err)
 		if status != websocket.StatusGoingAway && status != websocket.StatusNormalClosure {
-			log.Warn().Err(err).Str("peer", peer).Int("status", int(status)).Msg("could not write state to websocket; closing connection")
+			pub.sup.logger.Warn().Err(err).Str("peer", peer).Int("status", int(status)).Msg("could not write state to websocket; closing connection")
 		}
-		log.Info().Str("peer", peer).Int("status", int(status)).Msg("closing peer connection")
+		pub.sup.logger.Info().Str("peer", peer).Int("status", int(status)).Msg("closing peer connection")
 		_ = conn.ws.Close(websocket.StatusAbnormalClosure, "error writing state")
 		pub.mx.Lock()
 		delete(pub.connections, peer)
 		pub.mx.Unlock()
 		return
 	}
-	log.Info().Str("peer", peer).Msg("wrote state to peer")
+	pub.sup.logger.Info().Str("peer", peer).Msg("wrote state to peer")
 }
 
 func (pub *EventPublisher) publishState(current *State) {
@@ -0,0 +1,311 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mklimuk/gockpit"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrWriteFailed = errors.New("influx write failed")
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// LineWriter implements gockpit.Writer on top of the InfluxDB v2 HTTP write API. Points are
+// encoded in line protocol and sent in batches, either when the batch is full or periodically.
+type LineWriter struct {
+	mx            sync.Mutex
+	client        *http.Client
+	addr          string
+	org           string
+	token         string
+	batchSize     int
+	flushInterval time.Duration
+	logger        *zerolog.Logger
+	// pending lines per bucket
+	batches     map[string]*bytes.Buffer
+	pending     int
+	cancelFlush func()
+}
+
+type LineOption func(*LineWriter)
+
+// WithBatchSize sets the number of points buffered before they are written. Zero writes every point immediately.
+func WithBatchSize(size int) LineOption {
+	return func(w *LineWriter) {
+		w.batchSize = size
+	}
+}
+
+// WithFlushInterval sets how often buffered points are written regardless of the batch size.
+func WithFlushInterval(interval time.Duration) LineOption {
+	return func(w *LineWriter) {
+		w.flushInterval = interval
+	}
+}
+
+// WithLogger makes the writer log failed periodic flushes with logger instead of the global zerolog logger.
+func WithLogger(logger *zerolog.Logger) LineOption {
+	return func(w *LineWriter) {
+		w.logger = logger
+	}
+}
+
+func WithHTTPClient(client *http.Client) LineOption {
+	return func(w *LineWriter) {
+		w.client = client
+	}
+}
+
+func NewLineWriter(addr, org, token string, opts ...LineOption) *LineWriter {
+	w := &LineWriter{
+		client:        http.DefaultClient,
+		addr:          strings.TrimSuffix(addr, "/"),
+		org:           org,
+		token:         token,
+		batchSize:     128,
+		flushInterval: 10 * time.Second,
+		logger:        &log.Logger,
+		batches:       make(map[string]*bytes.Buffer),
+	}
+	for _, o := range opts {
+		o(w)
+	}
+	if w.flushInterval > 0 {
+		var ctx context.Context
+		ctx, w.cancelFlush = context.WithCancel(context.Background())
+		go w.flushLoop(ctx)
+	}
+	return w
+}
+
+// Save buffers the point and writes the whole batch using ctx once it is full.
+func (w *LineWriter) Save(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+	return w.SavePoints(ctx, bucket, name, []gockpit.Point{{Time: time.Now(), Fields: fields}}, tags)
+}
+
+// SavePoints implements gockpit.PointWriter buffering points with their timestamps; see Save.
+func (w *LineWriter) SavePoints(ctx context.Context, bucket, name string, points []gockpit.Point, tags map[string]string) error {
+	w.mx.Lock()
+	batch, found := w.batches[bucket]
+	if !found {
+		batch = &bytes.Buffer{}
+		w.batches[bucket] = batch
+	}
+	for _, p := range points {
+		line := encodeLine(name, p.Fields, tags, p.Time)
+		if line == nil {
+			// line protocol requires at least one field
+			continue
+		}
+		batch.Write(line)
+		w.pending++
+	}
+	full := w.pending >= w.batchSize
+	w.mx.Unlock()
+	if !full {
+		return nil
+	}
+	return w.Flush(ctx)
+}
+
+// Flush writes all buffered points. Points that could not be written are kept for the next attempt.
+func (w *LineWriter) Flush(ctx context.Context) error {
+	w.mx.Lock()
+	batches := w.batches
+	w.batches = make(map[string]*bytes.Buffer)
+	w.pending = 0
+	w.mx.Unlock()
+	var failed error
+	for bucket, batch := range batches {
+		err := w.write(ctx, bucket, batch.Bytes())
+		if err == nil {
+			continue
+		}
+		failed = err
+		w.requeue(bucket, batch)
+	}
+	return failed
+}
+
+// Close stops periodic flushing and writes the remaining points.
+func (w *LineWriter) Close() error {
+	if w.cancelFlush != nil {
+		w.cancelFlush()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return w.Flush(ctx)
+}
+
+func (w *LineWriter) requeue(bucket string, batch *bytes.Buffer) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	// older points go first
+	if newer, found := w.batches[bucket]; found {
+		batch.Write(newer.Bytes())
+	}
+	w.batches[bucket] = batch
+	w.pending += bytes.Count(batch.Bytes(), []byte{'\n'})
+}
+
+func (w *LineWriter) write(ctx context.Context, bucket string, body []byte) error {
+	query := url.Values{}
+	query.Set("org", w.org)
+	query.Set("bucket", bucket)
+	query.Set("precision", "ns")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.addr+"/api/v2/write?"+query.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create write request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not write points to bucket %s: %w", bucket, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%w: bucket %s responded with %d: %s", ErrWriteFailed, bucket, res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (w *LineWriter) flushLoop(ctx context.Context) {
+	tick := time.NewTicker(w.flushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			flushCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			err := w.Flush(flushCtx)
+			cancel()
+			if err != nil {
+				w.logger.Error().Err(err).Msg("could not flush buffered points")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// encodeLine renders a single point in line protocol. Fields of unsupported values are skipped
+// and nil is returned if no field is left.
+func encodeLine(name string, fields map[string]interface{}, tags map[string]string, ts time.Time) []byte {
+	var line bytes.Buffer
+	line.WriteString(measurementEscaper.Replace(name))
+	for _, key := range sortedKeys(tags) {
+		if key == "" || tags[key] == "" {
+			continue
+		}
+		line.WriteByte(',')
+		line.WriteString(keyEscaper.Replace(key))
+		line.WriteByte('=')
+		line.WriteString(keyEscaper.Replace(tags[key]))
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	written := 0
+	for _, key := range keys {
+		val, ok := encodeField(fields[key])
+		if !ok || key == "" {
+			continue
+		}
+		if written == 0 {
+			line.WriteByte(' ')
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(keyEscaper.Replace(key))
+		line.WriteByte('=')
+		line.WriteString(val)
+		written++
+	}
+	if written == 0 {
+		return nil
+	}
+	line.WriteByte(' ')
+	line.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	line.WriteByte('\n')
+	return line.Bytes()
+}
+
+func encodeField(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case float64:
+		return encodeFloat(v)
+	case float32:
+		return encodeFloat(float64(v))
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int8:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int16:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case uint:
+		return strconv.FormatUint(uint64(v), 10) + "u", true
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10) + "u", true
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10) + "u", true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10) + "u", true
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	case time.Duration:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case nil:
+		return "", false
+	default:
+		return `"` + stringEscaper.Replace(fmt.Sprint(v)) + `"`, true
+	}
+}
+
+func encodeFloat(f float64) (string, bool) {
+	// influx rejects NaN and infinities
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64), true
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,147 @@
+package influx
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mklimuk/gockpit"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeLine(t *testing.T) {
+	ts := time.Unix(0, 1600000000000000000)
+	tests := []struct {
+		name   string
+		point  string
+		fields map[string]interface{}
+		tags   map[string]string
+		line   string
+	}{
+		{"types", "state", map[string]interface{}{"f": 1.5, "i": 3, "u": uint(2), "b": true, "s": "ok", "none": nil},
+			nil, "state b=true,f=1.5,i=3i,s=\"ok\",u=2u 1600000000000000000\n"},
+		{"escaping", "my state,x", map[string]interface{}{"a key=1": `say "hi" \o/`},
+			map[string]string{"host name": "a,b=c"}, "my\\ state\\,x,host\\ name=a\\,b\\=c a\\ key\\=1=\"say \\\"hi\\\" \\\\o/\" 1600000000000000000\n"},
+		{"no fields", "state", map[string]interface{}{"nan": nil}, nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.line, string(encodeLine(test.point, test.fields, test.tags, ts)))
+		})
+	}
+}
+
+func TestLineWriter_Batching(t *testing.T) {
+	var mx sync.Mutex
+	var requests []*http.Request
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mx.Lock()
+		requests = append(requests, r)
+		bodies = append(bodies, string(body))
+		mx.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w := NewLineWriter(srv.URL, "org", "secret", WithBatchSize(3), WithFlushInterval(0))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, w.Save(ctx, "gockpit", "state", map[string]interface{}{"val": i}, nil))
+	}
+	mx.Lock()
+	assert.Empty(t, requests)
+	mx.Unlock()
+	require.NoError(t, w.Save(ctx, "gockpit", "state", map[string]interface{}{"val": 2}, nil))
+
+	mx.Lock()
+	defer mx.Unlock()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "/api/v2/write", requests[0].URL.Path)
+	assert.Equal(t, "org", requests[0].URL.Query().Get("org"))
+	assert.Equal(t, "gockpit", requests[0].URL.Query().Get("bucket"))
+	assert.Equal(t, "Token secret", requests[0].Header.Get("Authorization"))
+	assert.Equal(t, 3, strings.Count(bodies[0], "\n"))
+}
+
+func TestLineWriter_SavePoints(t *testing.T) {
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w := NewLineWriter(srv.URL, "org", "secret", WithBatchSize(0), WithFlushInterval(0))
+	points := []gockpit.Point{
+		{Time: time.Unix(0, 1500000000000000000), Fields: map[string]interface{}{"event": "start"}},
+		{Time: time.Unix(0, 1600000000000000000), Fields: map[string]interface{}{"val": 1}},
+	}
+	require.NoError(t, w.SavePoints(context.Background(), "gockpit", "state", points, nil))
+	assert.Equal(t, "state event=\"start\" 1500000000000000000\nstate val=1i 1600000000000000000\n", <-bodies)
+}
+
+func TestLineWriter_Failure(t *testing.T) {
+	fail := true
+	var lines int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			http.Error(w, "unauthorized access", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		lines += strings.Count(string(body), "\n")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w := NewLineWriter(srv.URL, "org", "", WithBatchSize(0), WithFlushInterval(0))
+	err := w.Save(context.Background(), "gockpit", "state", map[string]interface{}{"val": 1}, nil)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrWriteFailed))
+	assert.Contains(t, err.Error(), "unauthorized access")
+
+	// failed points are retried with the next batch
+	fail = false
+	require.NoError(t, w.Save(context.Background(), "gockpit", "state", map[string]interface{}{"val": 2}, nil))
+	assert.Equal(t, 2, lines)
+}
+
+// logLines passes log entries written by zerolog to a channel dropping them once it is full
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	select {
+	case l <- string(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestLineWriter_Logger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized access", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+	lines := make(logLines, 1)
+	logger := zerolog.New(lines)
+	w := NewLineWriter(srv.URL, "org", "", WithFlushInterval(10*time.Millisecond), WithLogger(&logger))
+	defer w.cancelFlush()
+	require.NoError(t, w.Save(context.Background(), "gockpit", "state", map[string]interface{}{"val": 1}, nil))
+	select {
+	case line := <-lines:
+		assert.Contains(t, line, `"message":"could not flush buffered points"`)
+	case <-time.After(time.Second):
+		t.Fatal("failed flush was not logged")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/mklimuk/gockpit"
 	"github.com/rs/zerolog/log"
 
 	influxdb "github.com/influxdata/influxdb-client-go"
@@ -126,8 +127,15 @@ func (s *Store) Close() {
 }
 
 func (s *Store) Save(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
-	s.metrics = append(s.metrics, influxdb.NewRowMetric(fields, name, tags, time.Now()))
-	if s.bufferSize == 0 || len(s.metrics) == s.bufferSize {
+	return s.SavePoints(ctx, bucket, name, []gockpit.Point{{Time: time.Now(), Fields: fields}}, tags)
+}
+
+// SavePoints implements gockpit.PointWriter saving points with their timestamps.
+func (s *Store) SavePoints(ctx context.Context, bucket, name string, points []gockpit.Point, tags map[string]string) error {
+	for _, p := range points {
+		s.metrics = append(s.metrics, influxdb.NewRowMetric(p.Fields, name, tags, p.Time))
+	}
+	if s.bufferSize == 0 || len(s.metrics) >= s.bufferSize {
 		err := s.sendAndRelease()
 		if err != nil {
 			return fmt.Errorf("could not save existing measurements: %w", err)
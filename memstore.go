@@ -0,0 +1,80 @@
+package gockpit
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StoredPoint is a point recorded by MemStore.
+type StoredPoint struct {
+	Point
+	Bucket string            `json:"bucket"`
+	Name   string            `json:"name"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+// MemStore is an in-memory ReadWriter keeping every saved point. It is meant for tests.
+type MemStore struct {
+	mx     sync.Mutex
+	points []StoredPoint
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{}
+}
+
+func (m *MemStore) Save(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+	return m.SavePoints(ctx, bucket, name, []Point{{Time: time.Now(), Fields: fields}}, tags)
+}
+
+// SavePoints implements PointWriter keeping the timestamps of points.
+func (m *MemStore) SavePoints(ctx context.Context, bucket, name string, points []Point, tags map[string]string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	var savedTags map[string]string
+	if tags != nil {
+		savedTags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			savedTags[k] = v
+		}
+	}
+	for _, p := range points {
+		m.points = append(m.points, StoredPoint{
+			Point:  Point{Time: p.Time, Fields: deepCopy(p.Fields).(map[string]interface{})},
+			Bucket: bucket,
+			Name:   name,
+			Tags:   savedTags,
+		})
+	}
+	return nil
+}
+
+func (m *MemStore) Query(ctx context.Context, bucket, name string, since time.Duration) ([]Point, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	var points []Point
+	for _, p := range m.points {
+		if p.Bucket != bucket || p.Name != name {
+			continue
+		}
+		if since == 0 || time.Since(p.Time) <= since {
+			points = append(points, p.Point)
+		}
+	}
+	// values set with SetAt may be saved with timestamps older than points saved before
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points, nil
+}
+
+// Points returns all points saved so far in the order they were saved.
+func (m *MemStore) Points() []StoredPoint {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	points := make([]StoredPoint, len(m.points))
+	copy(points, m.points)
+	return points
+}
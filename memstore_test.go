@@ -0,0 +1,62 @@
+package gockpit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store))
+	var count int
+	sup.AddProbe("count", time.Second, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		count++
+		mutation.Set("count", count)
+	}))
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		sup.tick(context.Background(), now)
+		now = now.Add(2 * time.Second)
+	}
+	points := store.Points()
+	require.Len(t, points, 3)
+	for i, p := range points {
+		assert.Equal(t, storeBucket, p.Bucket)
+		assert.Equal(t, "test", p.Name)
+		assert.Equal(t, i+1, p.Fields["count"])
+	}
+	queried, err := store.Query(context.Background(), storeBucket, "test", 0)
+	require.NoError(t, err)
+	assert.Len(t, queried, 3)
+
+	require.NoError(t, store.SavePoints(context.Background(), storeBucket, "test", []Point{{Time: now.Add(-time.Hour), Fields: map[string]interface{}{"event": 1}}}, nil))
+	queried, err = store.Query(context.Background(), storeBucket, "test", 0)
+	require.NoError(t, err)
+	require.Len(t, queried, 4)
+	assert.Equal(t, map[string]interface{}{"event": 1}, queried[0].Fields, "points are ordered by time")
+}
+
+func TestMemStore_DeepCopy(t *testing.T) {
+	store := NewMemStore()
+	fields := map[string]interface{}{
+		"nested": map[string]interface{}{"list": []interface{}{1, 2}},
+		"ints":   []int{1},
+	}
+	tags := map[string]string{"host": "a"}
+	require.NoError(t, store.Save(context.Background(), "bucket", "name", fields, tags))
+	fields["nested"].(map[string]interface{})["list"].([]interface{})[0] = 100
+	fields["ints"].([]int)[0] = 100
+	fields["added"] = true
+	tags["host"] = "b"
+
+	p := store.Points()[0]
+	assert.Equal(t, map[string]interface{}{
+		"nested": map[string]interface{}{"list": []interface{}{1, 2}},
+		"ints":   []int{1},
+	}, p.Fields)
+	assert.Equal(t, map[string]string{"host": "a"}, p.Tags)
+}
@@ -46,3 +46,52 @@ func (g *Float) Read() (interface{},error) {
 	}
 	return next, nil
 }
+
+func toFloat64(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
+// addNumeric adds delta to total keeping integer totals as int
+func addNumeric(total, delta interface{}) (interface{}, bool) {
+	if d, ok := delta.(int); ok {
+		switch t := total.(type) {
+		case nil:
+			return d, true
+		case int:
+			return t + d, true
+		}
+	}
+	d, ok := toFloat64(delta)
+	if !ok {
+		return total, false
+	}
+	if total == nil {
+		return d, true
+	}
+	t, ok := toFloat64(total)
+	if !ok {
+		return total, false
+	}
+	return t + d, true
+}
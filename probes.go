@@ -0,0 +1,37 @@
+package gockpit
+
+import (
+	"context"
+	"runtime"
+)
+
+// FuncGauge returns a probe setting key to the value returned by read.
+func FuncGauge(key string, read func() float64) ProbeFunc {
+	return func(_ context.Context, mutation *StateMutation) {
+		mutation.SetFloat(key, read())
+	}
+}
+
+// RuntimeMemProbe returns a probe reporting memory and goroutine statistics of the process under
+// runtime.heapAlloc, runtime.heapObjects, runtime.sys (bytes obtained from the OS), runtime.numGC
+// and runtime.goroutines. Reading memory statistics stops the world briefly so the probe
+// should not be sampled too often.
+func RuntimeMemProbe() ProbeFunc {
+	return func(_ context.Context, mutation *StateMutation) {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		mutation.SetInt("runtime.heapAlloc", int(stats.HeapAlloc)).
+			SetInt("runtime.heapObjects", int(stats.HeapObjects)).
+			SetInt("runtime.sys", int(stats.Sys)).
+			SetInt("runtime.numGC", int(stats.NumGC)).
+			SetInt("runtime.goroutines", runtime.NumGoroutine())
+	}
+}
+
+// ChannelLenProbe returns a probe setting key to the number of elements queued in ch,
+// e.g. to watch the backlog of a worker queue.
+func ChannelLenProbe[T any](key string, ch chan T) ProbeFunc {
+	return func(_ context.Context, mutation *StateMutation) {
+		mutation.SetInt(key, len(ch))
+	}
+}
@@ -0,0 +1,25 @@
+package gockpit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbeHelpers(t *testing.T) {
+	sup := NewSupervisor("test")
+	queue := make(chan string, 4)
+	queue <- "a"
+	queue <- "b"
+	sup.AddProbe("queue", 0, ChannelLenProbe("queue", queue))
+	sup.AddProbe("ratio", 0, FuncGauge("ratio", func() float64 { return 0.25 }))
+	sup.AddProbe("runtime", 0, RuntimeMemProbe())
+	st := sup.SampleNow(context.Background())
+
+	assert.Equal(t, 2, st.Int("queue"))
+	assert.Equal(t, 0.25, st.Float("ratio"))
+	assert.Greater(t, st.Int("runtime.heapAlloc"), 0)
+	assert.Greater(t, st.Int("runtime.sys"), 0)
+	assert.GreaterOrEqual(t, st.Int("runtime.goroutines"), 1)
+}
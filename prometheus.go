@@ -0,0 +1,149 @@
+package gockpit
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// handlerPrometheus exposes numeric state values as gauges and error occurrences
+// in the Prometheus text exposition format. Values of other types are skipped.
+func (s *Supervisor) handlerPrometheus(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", PrometheusContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(s.prometheusText())
+}
+
+func (s *Supervisor) prometheusText() []byte {
+	var buf bytes.Buffer
+	s.state.mx.RLock()
+	defer s.state.mx.RUnlock()
+	for _, v := range s.promValues() {
+		if v.histogram != nil {
+			writeSummary(&buf, v.name, *v.histogram)
+			continue
+		}
+		fmt.Fprintf(&buf, "# TYPE %s gauge\n%s %s\n", v.name, v.name, strconv.FormatFloat(v.val, 'g', -1, 64))
+	}
+	if len(s.state.errors) == 0 {
+		return buf.Bytes()
+	}
+	buf.WriteString("# TYPE gockpit_errors gauge\n")
+	for _, code := range s.state.errors.Codes() {
+		fmt.Fprintf(&buf, "gockpit_errors{supervisor=\"%s\",code=\"%s\"} %d\n", promLabel(s.name), promLabel(code), s.state.errors[code].Count)
+	}
+	return buf.Bytes()
+}
+
+// promValue is a numeric value or a histogram of the state exported to Prometheus
+type promValue struct {
+	name      string
+	key       string
+	val       float64
+	histogram *Histogram
+}
+
+// promValues returns exported values sorted by key; the state lock must be held
+func (s *Supervisor) promValues() []promValue {
+	keys := make([]string, 0, len(s.state.data))
+	for key := range s.state.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]promValue, 0, len(keys))
+	written := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		h, isHistogram := s.state.data[key].(Histogram)
+		val, ok := toFloat64(s.state.data[key])
+		if !ok && !isHistogram {
+			continue
+		}
+		name := promName("gockpit_" + s.name + "_" + s.nameTransformer(key))
+		if written[name] {
+			// different keys may collide after sanitization
+			continue
+		}
+		written[name] = true
+		v := promValue{name: name, key: key, val: val}
+		if isHistogram {
+			v.histogram = &h
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// Collector returns a prometheus.Collector reporting the values and errors exposed by the /metrics
+// endpoint so that the supervisor may be registered with an existing Prometheus registry.
+// The collector is unchecked since keys of the state appear and disappear over time.
+func (s *Supervisor) Collector() prometheus.Collector {
+	return collector{s}
+}
+
+var errorsDesc = prometheus.NewDesc("gockpit_errors", "Occurrences of unresolved errors.", []string{"supervisor", "code"}, nil)
+
+type collector struct {
+	supervisor *Supervisor
+}
+
+// Describe sends no descriptors which makes the collector unchecked.
+func (c collector) Describe(chan<- *prometheus.Desc) {}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	s := c.supervisor
+	s.state.mx.RLock()
+	defer s.state.mx.RUnlock()
+	for _, v := range s.promValues() {
+		desc := prometheus.NewDesc(v.name, fmt.Sprintf("Value of %s.", v.key), nil, nil)
+		if v.histogram == nil {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v.val)
+			continue
+		}
+		quantiles := make(map[float64]float64, len(Quantiles))
+		for i, val := range v.histogram.quantiles() {
+			quantiles[Quantiles[i]] = val
+		}
+		ch <- prometheus.MustNewConstSummary(desc, v.histogram.count, v.histogram.sum, quantiles)
+	}
+	for code, e := range s.state.errors {
+		ch <- prometheus.MustNewConstMetric(errorsDesc, prometheus.GaugeValue, float64(e.Count), s.name, code)
+	}
+}
+
+// writeSummary renders the histogram as a Prometheus summary
+func writeSummary(buf *bytes.Buffer, name string, h Histogram) {
+	fmt.Fprintf(buf, "# TYPE %s summary\n", name)
+	for i, val := range h.quantiles() {
+		fmt.Fprintf(buf, "%s{quantile=\"%s\"} %s\n", name, strconv.FormatFloat(Quantiles[i], 'g', -1, 64), strconv.FormatFloat(val, 'g', -1, 64))
+	}
+	fmt.Fprintf(buf, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64), name, h.count)
+}
+
+// promName replaces characters not allowed in Prometheus metric names with underscores
+func promName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+var promLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(val string) string {
+	return promLabelReplacer.Replace(val)
+}
@@ -0,0 +1,135 @@
+package gockpit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervisor_HandlerPrometheus(t *testing.T) {
+	sup := NewSupervisor("edge-1")
+	mutation := sup.state.With()
+	mutation.Set("cpu.load", 0.75).
+		Set("conn-count", 12).
+		Set("version", "1.2.3").
+		Set("online", true).
+		SetError("db", fmt.Errorf("connection \"refused\""))
+	mutation.Apply()
+
+	rec := httptest.NewRecorder()
+	sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	require.NoError(t, err)
+	assert.Len(t, families, 3)
+	require.Contains(t, families, "gockpit_edge_1_cpu_load")
+	assert.Equal(t, 0.75, families["gockpit_edge_1_cpu_load"].Metric[0].GetGauge().GetValue())
+	require.Contains(t, families, "gockpit_edge_1_conn_count")
+	assert.Equal(t, 12.0, families["gockpit_edge_1_conn_count"].Metric[0].GetGauge().GetValue())
+	require.Contains(t, families, "gockpit_errors")
+	errs := families["gockpit_errors"].Metric
+	require.Len(t, errs, 1)
+	assert.Equal(t, 1.0, errs[0].GetGauge().GetValue())
+	labels := map[string]string{}
+	for _, l := range errs[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, map[string]string{"supervisor": "edge-1", "code": "db"}, labels)
+}
+
+func TestSupervisor_NameTransformer(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("edge", WithStore(store), WithNameTransformer(func(name string) string {
+		return "node." + name
+	}, func(name string) string {
+		return strings.TrimPrefix(name, "node.")
+	}))
+	mutation := sup.state.With().Set("load", 0.5)
+	mutation.Apply()
+	sup.persist(time.Now(), mutation)
+
+	assert.Equal(t, 0.5, sup.GetState().Float("load"), "state keeps canonical names")
+	require.Len(t, store.Points(), 1)
+	assert.Equal(t, map[string]interface{}{"node.load": 0.5}, store.Points()[0].Fields)
+	history, err := sup.History(context.Background(), "load", 0)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, 0.5, history[0].Value)
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(sup.prometheusText()))
+	require.NoError(t, err)
+	assert.Contains(t, families, "gockpit_edge_node_load")
+}
+
+func TestSupervisor_RestoreNameTransformer(t *testing.T) {
+	underscores := func(name string) string { return strings.ReplaceAll(name, ".", "_") }
+	dots := func(name string) string { return strings.ReplaceAll(name, "_", ".") }
+	store := NewMemStore()
+	sup := NewSupervisor("edge", WithStore(store), WithNameTransformer(underscores, dots))
+	mutation := sup.state.With().Set("cpu.load", 0.5).Set("mem.used", 10)
+	mutation.Apply()
+	sup.persist(time.Now(), mutation)
+
+	restored := NewSupervisor("edge", WithStore(store), WithNameTransformer(underscores, dots))
+	require.NoError(t, restored.Restore(context.Background()))
+	state := restored.GetState()
+	assert.Equal(t, 0.5, state.Float("cpu.load"))
+	assert.Equal(t, 10, state.Int("mem.used"))
+	assert.Nil(t, state.Elem("cpu_load"), "stored names are mapped back")
+
+	// without an inverse stored names cannot be told apart from canonical ones
+	blind := NewSupervisor("edge", WithStore(store), WithNameTransformer(underscores, nil))
+	assert.ErrorIs(t, blind.Restore(context.Background()), ErrNoNameInverse)
+	assert.Nil(t, blind.GetState().Elem("cpu_load"))
+}
+
+func TestSupervisor_Collector(t *testing.T) {
+	sup := NewSupervisor("edge-1")
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(sup.Collector()))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, families)
+
+	// metrics appearing over time are collected
+	mutation := sup.state.With()
+	mutation.Set("cpu.load", 0.75).
+		Set("version", "1.2.3").
+		Observe("latency", 10).
+		SetError("db", fmt.Errorf("connection refused"))
+	mutation.Apply()
+	families, err = registry.Gather()
+	require.NoError(t, err)
+	gathered := make(map[string]*dto.MetricFamily, len(families))
+	for _, f := range families {
+		gathered[f.GetName()] = f
+	}
+	assert.Len(t, gathered, 3)
+	require.Contains(t, gathered, "gockpit_edge_1_cpu_load")
+	assert.Equal(t, 0.75, gathered["gockpit_edge_1_cpu_load"].Metric[0].GetGauge().GetValue())
+	require.Contains(t, gathered, "gockpit_edge_1_latency")
+	assert.EqualValues(t, 1, gathered["gockpit_edge_1_latency"].Metric[0].GetSummary().GetSampleCount())
+	require.Contains(t, gathered, "gockpit_errors")
+	errs := gathered["gockpit_errors"].Metric
+	require.Len(t, errs, 1)
+	assert.Equal(t, 1.0, errs[0].GetGauge().GetValue())
+	labels := make(map[string]string)
+	for _, l := range errs[0].Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+	assert.Equal(t, map[string]string{"supervisor": "edge-1", "code": "db"}, labels)
+}
@@ -0,0 +1,133 @@
+package gockpit
+
+import (
+	"sync"
+	"time"
+)
+
+// WithPushLimit limits values pushed with Push to at most n applies per interval for every key.
+// Pushes exceeding the limit are coalesced and the latest one is applied when the window closes.
+func WithPushLimit(n int, interval time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.pushLimit = &pushLimiter{
+			limit:    n,
+			interval: interval,
+			windows:  make(map[string]*pushWindow),
+		}
+	}
+}
+
+// Push sets a value reported outside of the sampling loop, e.g. by an event driven source.
+// Listeners are notified if the value has changed.
+func (s *Supervisor) Push(key string, val interface{}) {
+	if s.pushLimit != nil && !s.pushLimit.allow(key, val, s.clock.Now(), s.applyPush) {
+		return
+	}
+	s.applyPush(key, val)
+}
+
+// Set applies a value right away, e.g. the time of the last event seen by an event driven component.
+// Unlike Push it is not subject to WithPushLimit; a pushed value of key postponed by the limit is
+// discarded so that the value set last wins. Like Push, it is serialized with applying results
+// of probes and listeners are notified if the value has changed.
+func (s *Supervisor) Set(key string, val interface{}) {
+	if s.pushLimit != nil {
+		s.pushLimit.discard(key)
+	}
+	s.applyPush(key, val)
+}
+
+func (s *Supervisor) applyPush(key string, val interface{}) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	mutation := s.state.With()
+	mutation.Set(key, val)
+	mutation.Apply()
+	if !mutation.dirty() {
+		return
+	}
+	s.notify(s.runContext(), mutation)
+}
+
+type pushWindow struct {
+	start      time.Time
+	count      int
+	pending    interface{}
+	hasPending bool
+}
+
+type pushLimiter struct {
+	mx sync.Mutex
+	// clock schedules the end of windows; it is the one of the supervisor
+	clock    Clock
+	limit    int
+	interval time.Duration
+	windows  map[string]*pushWindow
+	dropped  uint64
+}
+
+// allow tells if the pushed value may be applied right away. Otherwise the value is kept
+// and passed to flush at the end of the current window replacing (dropping) older pending values.
+func (l *pushLimiter) allow(key string, val interface{}, now time.Time, flush func(string, interface{})) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	w, found := l.windows[key]
+	if !found {
+		w = &pushWindow{start: now}
+		l.windows[key] = w
+	}
+	if !w.hasPending && now.Sub(w.start) >= l.interval {
+		w.start = now
+		w.count = 0
+	}
+	if !w.hasPending && w.count < l.limit {
+		w.count++
+		return true
+	}
+	if w.hasPending {
+		l.dropped++
+	} else {
+		l.clock.AfterFunc(w.start.Add(l.interval).Sub(now), func() {
+			l.flush(key, l.clock.Now(), flush)
+		})
+	}
+	w.pending = val
+	w.hasPending = true
+	return false
+}
+
+func (l *pushLimiter) flush(key string, now time.Time, flush func(string, interface{})) {
+	l.mx.Lock()
+	w := l.windows[key]
+	if !w.hasPending {
+		// the pending value has been discarded
+		l.mx.Unlock()
+		return
+	}
+	val := w.pending
+	w.pending = nil
+	w.hasPending = false
+	w.start = now
+	w.count = 1
+	l.mx.Unlock()
+	flush(key, val)
+}
+
+// discard drops the pending value of key
+func (l *pushLimiter) discard(key string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	w, found := l.windows[key]
+	if !found || !w.hasPending {
+		return
+	}
+	w.pending = nil
+	w.hasPending = false
+	l.dropped++
+}
+
+func (l *pushLimiter) droppedCount() uint64 {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	return l.dropped
+}
@@ -0,0 +1,127 @@
+package gockpit
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/go-chi/chi"
+)
+
+var ErrDuplicateSupervisor = fmt.Errorf("supervisor already registered")
+
+// Registry holds named supervisors, e.g. one per subsystem, and exposes them with a single HTTP handler.
+type Registry struct {
+	mx          sync.RWMutex
+	supervisors map[string]registered
+}
+
+type registered struct {
+	supervisor *Supervisor
+	handler    http.Handler
+}
+
+func NewRegistry() *Registry {
+	return &Registry{supervisors: make(map[string]registered)}
+}
+
+// Register adds the supervisor under its name.
+func (r *Registry) Register(s *Supervisor) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if _, found := r.supervisors[s.name]; found {
+		return fmt.Errorf("%w: %s", ErrDuplicateSupervisor, s.name)
+	}
+	r.supervisors[s.name] = registered{supervisor: s, handler: s.HTTPHandler()}
+	return nil
+}
+
+// Unregister removes the supervisor of the given name.
+func (r *Registry) Unregister(name string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	delete(r.supervisors, name)
+}
+
+// Supervisor returns the supervisor registered under name.
+func (r *Registry) Supervisor(name string) (*Supervisor, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	reg, found := r.supervisors[name]
+	return reg.supervisor, found
+}
+
+// Names returns sorted names of registered supervisors.
+func (r *Registry) Names() []string {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	names := make([]string, 0, len(r.supervisors))
+	for name := range r.supervisors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HTTPHandler lists supervisors under /supervisors and serves routes of every supervisor's
+// HTTPHandler under /supervisors/{name}, e.g. /supervisors/{name}/state. /health is unhealthy
+// if any of the supervisors is.
+func (r *Registry) HTTPHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/supervisors", r.handlerSupervisors)
+	router.HandleFunc("/supervisors/{name}/*", r.handlerSupervisor)
+	router.Get("/health", r.handlerHealth)
+	return router
+}
+
+func (r *Registry) handlerSupervisors(w http.ResponseWriter, _ *http.Request) {
+	_ = writeJSONResponse(w, http.StatusOK, r.Names())
+}
+
+func (r *Registry) handlerSupervisor(w http.ResponseWriter, req *http.Request) {
+	name := chi.URLParam(req, "name")
+	r.mx.RLock()
+	reg, found := r.supervisors[name]
+	r.mx.RUnlock()
+	if !found {
+		_ = writeJSONResponse(w, http.StatusNotFound, struct {
+			Error string `json:"error"`
+		}{fmt.Sprintf("unknown supervisor %s", name)})
+		return
+	}
+	// continue routing the remaining path the way chi mounts sub-routers
+	rctx := chi.RouteContext(req.Context())
+	rctx.RoutePath = "/" + chi.URLParam(req, "*")
+	reg.handler.ServeHTTP(w, req)
+}
+
+type registryHealth struct {
+	Status      string            `json:"status"`
+	Supervisors map[string]health `json:"supervisors"`
+}
+
+func (r *Registry) handlerHealth(w http.ResponseWriter, req *http.Request) {
+	min, err := minSeverity(req)
+	if err != nil {
+		_ = writeJSONResponse(w, http.StatusBadRequest, struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	r.mx.RLock()
+	h := registryHealth{Status: "ok", Supervisors: make(map[string]health, len(r.supervisors))}
+	for name, reg := range r.supervisors {
+		member := reg.supervisor.health(min)
+		if !member.healthy() {
+			h.Status = "unhealthy"
+		}
+		h.Supervisors[name] = member
+	}
+	r.mx.RUnlock()
+	if h.Status != "ok" {
+		_ = writeJSONResponse(w, http.StatusServiceUnavailable, h)
+		return
+	}
+	_ = writeJSONResponse(w, http.StatusOK, h)
+}
@@ -0,0 +1,54 @@
+package gockpit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_HTTPHandler(t *testing.T) {
+	registry := NewRegistry()
+	net := NewSupervisor("net")
+	disk := NewSupervisor("disk")
+	require.NoError(t, registry.Register(net))
+	require.NoError(t, registry.Register(disk))
+	assert.ErrorIs(t, registry.Register(NewSupervisor("net")), ErrDuplicateSupervisor)
+	net.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	net.state.With().Set("temp", 20.0).Apply()
+
+	get := func(method, path string) (int, string) {
+		rec := httptest.NewRecorder()
+		registry.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	code, body := get(http.MethodGet, "/supervisors")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `["disk","net"]`, body)
+	code, body = get(http.MethodGet, "/supervisors/net/state")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"temp":20`)
+	code, _ = get(http.MethodGet, "/supervisors/cpu/state")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = get(http.MethodGet, "/health")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"status":"ok","supervisors":{"disk":{"status":"ok"},"net":{"status":"ok"}}}`, body)
+
+	net.state.With().Set("temp", 90.0).Apply()
+	code, body = get(http.MethodPost, "/supervisors/net/alerts/temp/ack")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"acked":true`)
+	disk.state.With().SetErrorLevel("sda", SeverityWarn, errors.New("slow")).Apply()
+	code, body = get(http.MethodGet, "/health")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.JSONEq(t, `{"status":"unhealthy","supervisors":{"disk":{"status":"unhealthy","errors":["sda"]},"net":{"status":"unhealthy","alerts":["temp"]}}}`, body)
+
+	registry.Unregister("net")
+	code, _ = get(http.MethodGet, "/health?severity=error")
+	assert.Equal(t, http.StatusOK, code)
+}
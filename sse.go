@@ -0,0 +1,57 @@
+package gockpit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// handlerStateStream streams the state as server-sent events. A snapshot is sent on connect
+// and another one after every state change.
+func (s *Supervisor) handlerStateStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		_ = writeJSONResponse(w, http.StatusInternalServerError, struct {
+			Error string `json:"error"`
+		}{"streaming is not supported"})
+		return
+	}
+	updates := make(chan struct{}, 1)
+	unsubscribe := s.AddListener(func(*State) {
+		// slow clients only get the latest state
+		select {
+		case updates <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	for {
+		if err := s.writeStateEvent(w); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-updates:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Supervisor) writeStateEvent(w http.ResponseWriter) error {
+	data, err := s.marshalState()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+func (s *Supervisor) marshalState() ([]byte, error) {
+	return json.Marshal(s.state)
+}
@@ -0,0 +1,54 @@
+package gockpit
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSupervisor_HandlerStateStream(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.Push("count", 1)
+	srv := httptest.NewServer(sup.HTTPHandler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/state/stream", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(res.Body)
+	readEvent := func() string {
+		line, err := events.ReadString('\n')
+		require.NoError(t, err)
+		_, err = events.ReadString('\n')
+		require.NoError(t, err)
+		return strings.TrimSpace(line)
+	}
+	assert.Equal(t, `data: {"state":{"count":1},"meta":{"version":1}}`, readEvent())
+	sup.Push("count", 2)
+	assert.Equal(t, `data: {"state":{"count":2},"meta":{"version":2}}`, readEvent())
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		sup.listenersMx.Lock()
+		subscribed := len(sup.listeners)
+		sup.listenersMx.Unlock()
+		if subscribed == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("stream listener was not unregistered")
+}
@@ -1,49 +1,369 @@
 package gockpit
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTypeMismatch = errors.New("type mismatch")
+
+// ErrKeyCollision is returned when flattened state data contains a key reserved for errors or alerts.
+var ErrKeyCollision = errors.New("state key collides with a reserved key")
+
+// JSONLayout controls how State is rendered to JSON. Empty key names fall back to the defaults:
+// state, errors, alerts and meta. Flat layout puts data at the top level next to errors and alerts.
+type JSONLayout struct {
+	Flat      bool
+	StateKey  string
+	ErrorsKey string
+	AlertsKey string
+	MetaKey   string
+}
+
+// Change tells what kind of state change listeners are notified about.
+type Change uint8
+
+const (
+	DataChange Change = 1 << iota
+	ErrorChange
+	AnyChange = DataChange | ErrorChange
 )
 
 type StateMutation struct {
 	state    *State
 	mutation *State
-	dirty    bool
+	deleted  map[string]bool
+	// increments are added to the state values when the mutation is applied
+	increments map[string]interface{}
+	// observations are added to histograms when the mutation is applied
+	observations map[string][]float64
+	changes      Change
+	// events are recorded when the mutation is applied
+	events []ChangeEvent
+}
+
+// ChangeEvent is a transition of the value of Key. Old is nil for added keys and New is nil
+// for deleted ones.
+type ChangeEvent struct {
+	Key string
+	Old interface{}
+	New interface{}
 }
 
 func (s *StateMutation) Set(key string, val interface{}) *StateMutation {
+	return s.SetAt(key, val, time.Time{})
+}
+
+// SetAt sets the value of key observed at ts, e.g. the time of the last event read from a queue.
+// Stores implementing PointWriter save it with ts; values set without an explicit timestamp
+// are saved with the time of the tick.
+func (s *StateMutation) SetAt(key string, val interface{}, ts time.Time) *StateMutation {
+	delete(s.deleted, key)
+	delete(s.increments, key)
+	delete(s.observations, key)
 	// if nothing changes the mutation remains empty
-	if s.state.data[key] == val {
+	s.state.mx.RLock()
+	current, currentTs := s.state.data[key], s.state.timestamps[key]
+	s.state.mx.RUnlock()
+	if equal(current, val) && currentTs.Equal(ts) {
 		return s
 	}
-	s.dirty = true
+	s.changes |= DataChange
 	s.mutation.set(key, val)
+	s.mutation.setTimestamp(key, ts)
+	return s
+}
+
+// SetInt sets an integer value. Typed setters store values in the types expected by the getters.
+func (s *StateMutation) SetInt(key string, val int) *StateMutation {
+	return s.Set(key, val)
+}
+
+// SetFloat sets a float64 value.
+func (s *StateMutation) SetFloat(key string, val float64) *StateMutation {
+	return s.Set(key, val)
+}
+
+// SetString sets a string value.
+func (s *StateMutation) SetString(key string, val string) *StateMutation {
+	return s.Set(key, val)
+}
+
+// SetBool sets a bool value.
+func (s *StateMutation) SetBool(key string, val bool) *StateMutation {
+	return s.Set(key, val)
+}
+
+// SetDuration sets a time.Duration value.
+func (s *StateMutation) SetDuration(key string, val time.Duration) *StateMutation {
+	return s.Set(key, val)
+}
+
+// Incr adds delta to the value of key. The value is read when the mutation is applied so that
+// increments of several probes within a tick add up.
+func (s *StateMutation) Incr(key string, delta float64) *StateMutation {
+	return s.incr(key, delta)
+}
+
+// IncrInt adds delta to the value of key keeping it an int. See Incr.
+func (s *StateMutation) IncrInt(key string, delta int) *StateMutation {
+	return s.incr(key, delta)
+}
+
+// Observe adds val to the histogram kept under key, e.g. a latency measured by the probe.
+// The histogram is created on the first observation; see Histogram.
+func (s *StateMutation) Observe(key string, val float64) *StateMutation {
+	if s.observations == nil {
+		s.observations = make(map[string][]float64)
+	}
+	s.observations[key] = append(s.observations[key], val)
+	delete(s.deleted, key)
+	s.changes |= DataChange
+	return s
+}
+
+func (s *StateMutation) incr(key string, delta interface{}) *StateMutation {
+	if val, found := s.mutation.data[key]; found {
+		// the value has been set by this mutation
+		if sum, ok := addNumeric(val, delta); ok {
+			s.mutation.set(key, sum)
+			return s
+		}
+	}
+	if s.increments == nil {
+		s.increments = make(map[string]interface{})
+	}
+	if sum, ok := addNumeric(s.increments[key], delta); ok {
+		s.increments[key] = sum
+	} else {
+		s.increments[key] = delta
+	}
+	delete(s.deleted, key)
+	s.changes |= DataChange
+	return s
+}
+
+func (s *State) setMeta(meta *runMeta) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.meta = meta
+}
+
+// Delete removes key from the state together with its error. Alerts watching the key stay registered
+// and are reset so that they start over if the key is set again.
+func (s *StateMutation) Delete(key string) *StateMutation {
+	delete(s.increments, key)
+	delete(s.observations, key)
+	delete(s.mutation.data, key)
+	delete(s.mutation.timestamps, key)
+	delete(s.mutation.errors, key)
+	if s.deleted == nil {
+		s.deleted = make(map[string]bool)
+	}
+	s.deleted[key] = true
+	s.changes |= DataChange
+	return s
+}
+
+// SetGroup sets every field under prefix.key so that related values are kept together.
+func (s *StateMutation) SetGroup(prefix string, fields map[string]interface{}) *StateMutation {
+	for key, val := range fields {
+		s.Set(groupKey(prefix, key), val)
+	}
+	return s
+}
+
+// DeleteGroup removes all keys set with SetGroup under prefix; see Delete.
+func (s *StateMutation) DeleteGroup(prefix string) *StateMutation {
+	prefix = groupKey(prefix, "")
+	var keys []string
+	s.state.mx.RLock()
+	for key := range s.state.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	s.state.mx.RUnlock()
+	for key := range s.mutation.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		s.Delete(key)
+	}
 	return s
 }
 
+func groupKey(prefix, key string) string {
+	return prefix + "." + key
+}
+
+// SetError reports an error for the given key; a nil error resolves the previous one.
 func (s *StateMutation) SetError(key string, err error) *StateMutation {
-	if s.state.errors == nil {
-		s.state.errors = make(Errors)
+	return s.SetErrorLevel(key, SeverityError, err)
+}
+
+// SetErrorLevel reports an error of the given severity for the key; see SetError.
+func (s *StateMutation) SetErrorLevel(key string, severity Severity, err error) *StateMutation {
+	if s.mutation.errors == nil {
+		s.mutation.errors = make(Errors)
 	}
-	if err == s.state.errors[key].Err {
+	// every report is recorded so that retries can tell if sampling failed
+	s.mutation.errors[key] = Error{Err: err, Severity: severity}
+	s.state.mx.RLock()
+	current := s.state.getError(key)
+	s.state.mx.RUnlock()
+	if err == current {
 		return s
 	}
-	s.dirty = true
-	s.mutation.setError(key, err)
+	s.changes |= ErrorChange
 	return s
 }
 
+// take removes the value recorded for key from the mutation
+func (s *StateMutation) take(key string) (interface{}, bool) {
+	val, found := s.mutation.data[key]
+	if found {
+		delete(s.mutation.data, key)
+	}
+	return val, found
+}
+
+func (s *StateMutation) failed(key string) bool {
+	return s.mutation.errors[key].Err != nil
+}
+
+// merge copies changes recorded in other into s
+func (s *StateMutation) merge(other *StateMutation) {
+	for key, val := range other.mutation.data {
+		s.mutation.set(key, val)
+		s.mutation.setTimestamp(key, other.mutation.timestamps[key])
+	}
+	for key, e := range other.mutation.errors {
+		s.SetErrorLevel(key, e.Severity, e.Err)
+	}
+	for key, delta := range other.increments {
+		s.incr(key, delta)
+	}
+	for key, values := range other.observations {
+		for _, val := range values {
+			s.Observe(key, val)
+		}
+	}
+	for key := range other.deleted {
+		s.Delete(key)
+	}
+	s.changes |= other.changes
+	s.events = append(s.events, other.events...)
+}
+
+// ChangedKeys returns sorted keys whose values are changed, incremented or deleted by the mutation.
+func (s *StateMutation) ChangedKeys() []string {
+	keys := make([]string, 0, len(s.mutation.data)+len(s.increments)+len(s.observations)+len(s.deleted))
+	for key := range s.mutation.data {
+		keys = append(keys, key)
+	}
+	for key := range s.observations {
+		keys = append(keys, key)
+	}
+	for key := range s.increments {
+		keys = append(keys, key)
+	}
+	for key := range s.deleted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// a key may be both set and incremented when the increment could not be folded into its value
+	unique := keys[:0]
+	for i, key := range keys {
+		if i == 0 || key != keys[i-1] {
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+func (s *StateMutation) dirty() bool {
+	return s.changes != 0
+}
+
+func (s *StateMutation) changed(key string) bool {
+	_, found := s.mutation.data[key]
+	_, incremented := s.increments[key]
+	return found || incremented
+}
+
 func (s *StateMutation) Apply() {
-	s.state.apply(s.mutation)
+	s.events = append(s.events, s.state.apply(s.mutation, s.increments, s.observations, s.deleted, s.dirty())...)
+}
+
+// Events returns transitions of values made by applying the mutation sorted by key.
+// Values set, incremented and deleted within a mutation yield a single event per key.
+func (s *StateMutation) Events() []ChangeEvent {
+	return s.events
 }
 
 type State struct {
-	mx     sync.RWMutex
-	data   map[string]interface{}
-	errors Errors
-	alerts Alerts
+	// version is bumped on every change; it is accessed atomically and kept first for alignment
+	version uint64
+	mx      sync.RWMutex
+	data    map[string]interface{}
+	errors  Errors
+	alerts  Alerts
+	// verboseErrors makes MarshalJSON render error chains and stack traces
+	verboseErrors bool
+	alertNotifier AlertNotifier
+	layout        *JSONLayout
+	// meta describes the sampling loop once it is running
+	meta *runMeta
+	// maxErrors limits the number of errors kept; zero means no limit
+	maxErrors     int
+	evictedErrors uint64
+	// histogramWindow is the period histograms summarize
+	histogramWindow time.Duration
+	// timestamps of values set with SetAt
+	timestamps map[string]time.Time
+	// clock evaluates alerts and histograms and stamps errors; system time is used if nil
+	clock Clock
+}
+
+func (s *State) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+// setTimestamp records the explicit timestamp of the value of key; zero ts removes it
+func (s *State) setTimestamp(key string, ts time.Time) {
+	if ts.IsZero() {
+		delete(s.timestamps, key)
+		return
+	}
+	if s.timestamps == nil {
+		s.timestamps = make(map[string]time.Time)
+	}
+	s.timestamps[key] = ts
+}
+
+// Timestamp returns the time the value of key has been observed at if it has been set with SetAt.
+func (s *State) Timestamp(key string) (time.Time, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	ts, found := s.timestamps[key]
+	return ts, found
 }
 
 func (s *State) With() *StateMutation {
@@ -53,26 +373,420 @@ func (s *State) With() *StateMutation {
 	}
 }
 
+// MarshalJSON renders the state. Its sections are copied under the state lock which is released
+// before encoding so the state must not be locked by the caller.
 func (s *State) MarshalJSON() ([]byte, error) {
+	s.mx.RLock()
+	data := make(map[string]interface{}, len(s.data))
+	for key, val := range s.data {
+		data[key] = val
+	}
+	var errs interface{}
+	if len(s.errors) > 0 {
+		if s.verboseErrors {
+			errs = s.errors.verbose()
+		} else {
+			errs = s.errors.json()
+		}
+	}
+	now := s.now()
+	var alerts map[string]alertJSON
+	if len(s.alerts) > 0 {
+		alerts = make(map[string]alertJSON, len(s.alerts))
+		for id, a := range s.alerts {
+			alerts[id] = a.json(id, now)
+		}
+	}
+	var meta *stateMeta
+	if version := atomic.LoadUint64(&s.version); version > 0 || s.meta != nil {
+		meta = &stateMeta{Version: version}
+		if s.meta != nil {
+			meta.runMeta = s.meta.at(now)
+		}
+	}
+	layout := s.layout
+	s.mx.RUnlock()
+
+	if layout != nil {
+		return layout.marshal(data, errs, alerts, meta)
+	}
 	return json.Marshal(struct {
 		State  map[string]interface{} `json:"state"`
-		Errors Errors                 `json:"errors,omitempty"`
-		Alerts Alerts                 `json:"alerts,omitempty"`
-	}{s.data, s.errors, s.alerts})
+		Errors interface{}            `json:"errors,omitempty"`
+		Alerts map[string]alertJSON   `json:"alerts,omitempty"`
+		Meta   *stateMeta             `json:"meta,omitempty"`
+	}{data, errs, alerts, meta})
 }
 
-// Apply copies another state into s. This relies on the assumption that state is extensible only and nothing gets deleted from it.
-func (s *State) apply(other *State) {
+// stateMeta is rendered in the reserved meta section of the state
+type stateMeta struct {
+	Version uint64 `json:"version"`
+	*runMeta
+}
+
+// Version returns the number of changes applied to the state. It only grows so clients
+// may compare versions to tell if the state has changed.
+func (s *State) Version() uint64 {
+	return atomic.LoadUint64(&s.version)
+}
+
+// keys returns the section keys falling back to the defaults; nil layout is the default one
+func (l *JSONLayout) keys() (stateKey, errorsKey, alertsKey, metaKey string) {
+	stateKey, errorsKey, alertsKey, metaKey = "state", "errors", "alerts", "meta"
+	if l == nil {
+		return
+	}
+	if l.StateKey != "" {
+		stateKey = l.StateKey
+	}
+	if l.ErrorsKey != "" {
+		errorsKey = l.ErrorsKey
+	}
+	if l.AlertsKey != "" {
+		alertsKey = l.AlertsKey
+	}
+	if l.MetaKey != "" {
+		metaKey = l.MetaKey
+	}
+	return
+}
+
+func (l *JSONLayout) marshal(data map[string]interface{}, errs interface{}, alerts map[string]alertJSON, meta *stateMeta) ([]byte, error) {
+	stateKey, errorsKey, alertsKey, metaKey := l.keys()
+	out := make(map[string]interface{}, len(data)+2)
+	if l.Flat {
+		for key, val := range data {
+			if key == errorsKey || key == alertsKey || key == metaKey {
+				return nil, fmt.Errorf("%w: %s", ErrKeyCollision, key)
+			}
+			out[key] = val
+		}
+	} else {
+		out[stateKey] = data
+	}
+	if errs != nil {
+		out[errorsKey] = errs
+	}
+	if len(alerts) > 0 {
+		out[alertsKey] = alerts
+	}
+	if meta != nil {
+		out[metaKey] = meta
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads the state rendered by MarshalJSON using the layout of s. Numbers are
+// decoded as int when integral and float64 otherwise. Errors are restored with their messages
+// and occurrence history only, alerts with their status; they are not evaluated any more.
+// Only the version is read from the meta section.
+func (s *State) UnmarshalJSON(b []byte) error {
+	stateKey, errorsKey, alertsKey, metaKey := s.layout.keys()
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(b, &sections); err != nil {
+		return err
+	}
+	data := make(map[string]interface{})
+	if s.layout != nil && s.layout.Flat {
+		for key, raw := range sections {
+			if key == errorsKey || key == alertsKey || key == metaKey {
+				continue
+			}
+			var val interface{}
+			if err := decodeNumbers(raw, &val); err != nil {
+				return fmt.Errorf("could not decode %s: %w", key, err)
+			}
+			data[key] = restoredValue(val)
+		}
+	} else if raw, found := sections[stateKey]; found {
+		if err := decodeNumbers(raw, &data); err != nil {
+			return fmt.Errorf("could not decode %s: %w", stateKey, err)
+		}
+		for key, val := range data {
+			data[key] = restoredValue(val)
+		}
+	}
+	var errs Errors
+	if raw, found := sections[errorsKey]; found {
+		var decoded map[string]errorJSON
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return fmt.Errorf("could not decode %s: %w", errorsKey, err)
+		}
+		errs = make(Errors, len(decoded))
+		for code, e := range decoded {
+			errs[code] = Error{Err: errors.New(e.Error), Count: e.Count, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen, Severity: e.Severity}
+		}
+	}
+	var alerts Alerts
+	if raw, found := sections[alertsKey]; found {
+		var decoded map[string]alertJSON
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return fmt.Errorf("could not decode %s: %w", alertsKey, err)
+		}
+		alerts = make(Alerts, len(decoded))
+		for id, a := range decoded {
+			alerts[id] = a.alert(id)
+		}
+	}
+	var meta struct {
+		Version uint64 `json:"version"`
+	}
+	if raw, found := sections[metaKey]; found {
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return fmt.Errorf("could not decode %s: %w", metaKey, err)
+		}
+	}
 	s.mx.Lock()
 	defer s.mx.Unlock()
+	s.data, s.errors, s.alerts = data, errs, alerts
+	atomic.StoreUint64(&s.version, meta.Version)
+	return nil
+}
+
+func decodeNumbers(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// MarshalCSV renders the state data as key,value records sorted by key.
+func (s *State) MarshalCSV() ([]byte, error) {
+	s.mx.RLock()
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([][]string, 0, len(keys)+1)
+	records = append(records, []string{"key", "value"})
+	for _, key := range keys {
+		records = append(records, []string{key, fmt.Sprintf("%v", s.data[key])})
+	}
+	s.mx.RUnlock()
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.WriteAll(records); err != nil {
+		return nil, fmt.Errorf("could not write csv: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Snapshot returns a deep copy of the state data taken at a single point in time.
+// The returned map is owned by the caller and safe to mutate.
+func (s *State) Snapshot() map[string]interface{} {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.snapshotData()
+}
+
+// PrefixOption configures State.Prefix.
+type PrefixOption func(*prefixConfig)
+
+type prefixConfig struct {
+	strip bool
+}
+
+// WithStrippedPrefix makes State.Prefix return keys without the prefix, e.g. active instead of pool.active.
+func WithStrippedPrefix() PrefixOption {
+	return func(c *prefixConfig) {
+		c.strip = true
+	}
+}
+
+// Prefix returns a deep copy of the entries whose keys start with prefix taken at a single point in time.
+// Keys retain the prefix unless WithStrippedPrefix is given.
+func (s *State) Prefix(prefix string, opts ...PrefixOption) map[string]interface{} {
+	var config prefixConfig
+	for _, o := range opts {
+		o(&config)
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	data := make(map[string]interface{})
+	for key, val := range s.data {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if config.strip {
+			key = key[len(prefix):]
+		}
+		data[key] = deepCopy(val)
+	}
+	return data
+}
+
+// SnapshotState returns a frozen copy of the state including errors and alerts.
+// It is not affected by later changes and may be freely modified by the caller.
+func (s *State) SnapshotState() *State {
+	return s.project(nil)
+}
+
+// project returns a frozen copy of the state like SnapshotState. If keys are given, the copy
+// is limited to their values, errors and the alerts watching them; unknown keys are ignored.
+func (s *State) project(keys map[string]bool) *State {
+	included := func(key string) bool {
+		return keys == nil || keys[key]
+	}
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	snapshot := &State{
+		version:       atomic.LoadUint64(&s.version),
+		data:          make(map[string]interface{}, len(s.data)),
+		verboseErrors: s.verboseErrors,
+		layout:        s.layout,
+		meta:          s.meta,
+		clock:         s.clock,
+	}
+	for key, val := range s.data {
+		if included(key) {
+			snapshot.data[key] = deepCopy(val)
+		}
+	}
+	for key, ts := range s.timestamps {
+		if included(key) {
+			snapshot.setTimestamp(key, ts)
+		}
+	}
+	if s.errors != nil {
+		snapshot.errors = make(Errors, len(s.errors))
+		for key, e := range s.errors {
+			if included(key) {
+				snapshot.errors[key] = e
+			}
+		}
+	}
+	if s.alerts != nil {
+		snapshot.alerts = make(Alerts, len(s.alerts))
+		for id, a := range s.alerts {
+			if included(id) || included(a.metric(id)) {
+				alert := *a
+				snapshot.alerts[id] = &alert
+			}
+		}
+	}
+	return snapshot
+}
+
+func (s *State) snapshotData() map[string]interface{} {
+	data := make(map[string]interface{}, len(s.data))
+	for key, val := range s.data {
+		data[key] = deepCopy(val)
+	}
+	return data
+}
+
+// apply copies another state into s, adds increments and observations and removes deleted keys.
+// The version is bumped if the mutation is dirty. It returns transitions of the values.
+func (s *State) apply(other *State, increments map[string]interface{}, observations map[string][]float64, deleted map[string]bool, dirty bool) []ChangeEvent {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if dirty {
+		defer atomic.AddUint64(&s.version, 1)
+	}
 	if s.data == nil {
 		s.data = make(map[string]interface{})
 	}
+	// values of keys touched by the mutation are compared with the new ones once it is applied
+	old := make(map[string]interface{}, len(other.data)+len(increments)+len(observations)+len(deleted))
+	for key := range other.data {
+		old[key] = s.data[key]
+	}
+	for key := range increments {
+		old[key] = s.data[key]
+	}
+	for key := range observations {
+		old[key] = s.data[key]
+	}
+	for key := range deleted {
+		old[key] = s.data[key]
+	}
 	for key, val := range other.data {
 		s.data[key] = val
+		s.setTimestamp(key, other.timestamps[key])
+	}
+	for key, delta := range increments {
+		sum, ok := addNumeric(s.data[key], delta)
+		if !ok {
+			s.collectError(key, SeverityError, fmt.Errorf("could not increment: %w", mismatch(key, "number", s.data[key])))
+			continue
+		}
+		s.data[key] = sum
+		s.setTimestamp(key, time.Time{})
+	}
+	now := s.now()
+	for key, values := range observations {
+		h, ok := s.data[key].(Histogram)
+		if !ok && s.data[key] != nil {
+			s.collectError(key, SeverityError, fmt.Errorf("could not observe: %w", mismatch(key, "histogram", s.data[key])))
+			continue
+		}
+		window := s.histogramWindow
+		if window <= 0 {
+			window = defaultHistogramWindow
+		}
+		s.data[key] = h.observe(now, window, values)
+		s.setTimestamp(key, time.Time{})
+	}
+	for key, e := range other.errors {
+		if s.errors[key].collected {
+			continue
+		}
+		if e.Err == nil {
+			delete(s.errors, key)
+			continue
+		}
+		s.collectError(key, e.Severity, e.Err)
 	}
-	for key, a := range s.alerts {
-		a.update(s.data[key], a)
+	for key := range deleted {
+		s.delete(key)
+	}
+	var events []ChangeEvent
+	for key, val := range old {
+		if current := s.data[key]; !equal(val, current) {
+			events = append(events, ChangeEvent{Key: key, Old: val, New: current})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+	// expression alerts get a view of the state so that its lock, held here, is not taken again
+	var view *State
+	for id, a := range s.alerts {
+		var val interface{}
+		if a.expr != nil {
+			if view == nil {
+				view = &State{data: s.data, errors: s.errors, verboseErrors: s.verboseErrors}
+			}
+			val = view
+		} else {
+			val = s.data[a.metric(id)]
+		}
+		if !a.shouldNotify(a.evaluate(val, now), now) {
+			continue
+		}
+		if s.alertNotifier != nil {
+			s.alertNotifier(id, a, a.IsSet)
+		}
+	}
+	return events
+}
+
+// Delete removes key from the state like StateMutation.Delete.
+func (s *State) Delete(key string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.delete(key)
+	atomic.AddUint64(&s.version, 1)
+}
+
+func (s *State) delete(key string) {
+	delete(s.data, key)
+	delete(s.timestamps, key)
+	delete(s.errors, key)
+	for id, a := range s.alerts {
+		if a.expr == nil && a.metric(id) == key {
+			a.reset()
+		}
 	}
 }
 
@@ -86,83 +800,212 @@ func (s *State) set(key string, val interface{}) *State {
 	return s
 }
 
-func (s *State) Int(name string) int {
+// Get returns the value stored under name if it is of type T. Missing values and values of other
+// types are reported as the zero value of T and false. Unlike the typed methods of State, which
+// panic on mismatch, Get never panics and is the preferred way of reading the state.
+func Get[T any](s *State, name string) (T, bool) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	if s.data == nil {
-		s.data = make(map[string]interface{})
+	val, ok := s.data[name].(T)
+	return val, ok
+}
+
+func (s *State) Int(name string) int {
+	i, err := s.GetInt(name)
+	if err != nil {
+		panic(err)
 	}
+	return i
+}
+
+// GetInt returns the integer stored under name or ErrTypeMismatch if the value is of another type.
+// Missing values are reported as 0.
+func (s *State) GetInt(name string) (int, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
 	val := s.data[name]
 	if val == nil {
-		return 0
+		return 0, nil
 	}
 	switch i := val.(type) {
 	case int:
-		return i
+		return i, nil
 	case int32:
-		return int(i)
+		return int(i), nil
 	case int8:
-		return int(i)
+		return int(i), nil
 	case int64:
-		return int(i)
+		return int(i), nil
 	default:
-		panic(fmt.Errorf("%v is not of integer type", i))
+		return 0, mismatch(name, "integer", val)
 	}
 }
 
 func (s *State) Float(name string) float64 {
+	f, err := s.GetFloat(name)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// GetFloat returns the float stored under name or ErrTypeMismatch if the value is of another type.
+// Missing values are reported as 0.
+func (s *State) GetFloat(name string) (float64, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	if s.data == nil {
-		s.data = make(map[string]interface{})
-	}
 	val := s.data[name]
 	if val == nil {
-		return 0.0
+		return 0.0, nil
 	}
 	switch i := val.(type) {
 	case float32:
-		return float64(i)
+		return float64(i), nil
 	case float64:
-		return i
+		return i, nil
 	default:
-		panic(fmt.Errorf("%v is not of float type", i))
+		return 0.0, mismatch(name, "float", val)
 	}
 }
 
-func (s *State) Elem(name string) interface{} {
+// GetHistogram returns the histogram stored under name or ErrTypeMismatch if the value is of another type.
+// Missing values are reported as an empty histogram.
+func (s *State) GetHistogram(name string) (Histogram, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	if s.data == nil {
-		s.data = make(map[string]interface{})
+	val := s.data[name]
+	if val == nil {
+		return Histogram{}, nil
+	}
+	h, ok := val.(Histogram)
+	if !ok {
+		return Histogram{}, mismatch(name, "histogram", val)
 	}
+	return h, nil
+}
+
+// Percentile returns the estimated q-quantile (0-1) of the histogram stored under name.
+// It is NaN if there are no observations and panics if the value is not a histogram.
+func (s *State) Percentile(name string, q float64) float64 {
+	h, err := s.GetHistogram(name)
+	if err != nil {
+		panic(err)
+	}
+	return h.Quantile(q)
+}
+
+func (s *State) Elem(name string) interface{} {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
 	return s.data[name]
 }
 
 func (s *State) Bool(name string) bool {
+	b, err := s.GetBool(name)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// GetBool returns the boolean stored under name or ErrTypeMismatch if the value is of another type.
+// Missing values are reported as false.
+func (s *State) GetBool(name string) (bool, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	if s.data == nil {
-		s.data = make(map[string]interface{})
-	}
 	val := s.data[name]
 	if val == nil {
-		return false
+		return false, nil
 	}
 	switch i := val.(type) {
 	case bool:
-		return i
+		return i, nil
 	default:
-		panic(fmt.Errorf("%v is not of boolean type", i))
+		return false, mismatch(name, "boolean", val)
 	}
 }
 
-func (s *State) String(name string) string {
+func (s *State) Duration(name string) time.Duration {
+	d, err := s.GetDuration(name)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// GetDuration returns the duration stored under name or ErrTypeMismatch if the value is of another type.
+// Integers are read as nanoseconds and strings are parsed with time.ParseDuration, which covers
+// values restored from JSON. Missing values are reported as 0.
+func (s *State) GetDuration(name string) (time.Duration, error) {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	if s.data == nil {
-		s.data = make(map[string]interface{})
+	val := s.data[name]
+	if val == nil {
+		return 0, nil
+	}
+	switch d := val.(type) {
+	case time.Duration:
+		return d, nil
+	case int:
+		return time.Duration(d), nil
+	case int64:
+		return time.Duration(d), nil
+	case float64:
+		if d != math.Trunc(d) {
+			return 0, mismatch(name, "duration", val)
+		}
+		return time.Duration(d), nil
+	case string:
+		parsed, err := time.ParseDuration(d)
+		if err != nil {
+			return 0, mismatch(name, "duration", val)
+		}
+		return parsed, nil
+	default:
+		return 0, mismatch(name, "duration", val)
+	}
+}
+
+func (s *State) Time(name string) time.Time {
+	t, err := s.GetTime(name)
+	if err != nil {
+		panic(err)
 	}
+	return t
+}
+
+// GetTime returns the time stored under name or ErrTypeMismatch if the value is of another type.
+// Strings are parsed as RFC3339 timestamps. Missing values are reported as zero time.
+func (s *State) GetTime(name string) (time.Time, error) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	val := s.data[name]
+	if val == nil {
+		return time.Time{}, nil
+	}
+	switch t := val.(type) {
+	case time.Time:
+		return t, nil
+	case Time:
+		return t.Time, nil
+	case string:
+		parsed, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return time.Time{}, mismatch(name, "time", val)
+		}
+		return parsed, nil
+	default:
+		return time.Time{}, mismatch(name, "time", val)
+	}
+}
+
+func mismatch(name, expected string, val interface{}) error {
+	return fmt.Errorf("%w: %s holds %v of type %T; %s expected", ErrTypeMismatch, name, val, val, expected)
+}
+
+func (s *State) String(name string) string {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
 	val := s.data[name]
 	if val == nil {
 		return ""
@@ -186,19 +1029,41 @@ func (s *State) String(name string) string {
 }
 
 func (s *State) HasErrors() bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
 	return len(s.errors) > 0
 }
 
+// HasErrorsAtLeast tells if the state holds errors of at least the given severity.
+func (s *State) HasErrorsAtLeast(min Severity) bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	for _, e := range s.errors {
+		if e.Severity >= min {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *State) Err(name string) error {
 	s.mx.RLock()
 	defer s.mx.RUnlock()
-	if s.errors == nil {
-		return nil
+	if err, found := s.errors[name]; found {
+		return err
 	}
-	return s.errors[name]
+	return nil
 }
 
-func (s *State) setError(code string, err error) *State {
+// ErrorDetail returns the unresolved error reported for code together with its occurrence history.
+func (s *State) ErrorDetail(code string) (Error, bool) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	e, found := s.errors[code]
+	return e, found
+}
+
+func (s *State) setError(code string, severity Severity, err error) *State {
 	s.mx.Lock()
 	defer s.mx.Unlock()
 	if s.errors == nil {
@@ -208,13 +1073,44 @@ func (s *State) setError(code string, err error) *State {
 		// clear previous occurrence
 		if _, found := s.errors[code]; found {
 			delete(s.errors, code)
+			atomic.AddUint64(&s.version, 1)
 		}
 		return s
 	}
-	s.errors.Collect(code, err)
+	s.collectError(code, severity, err)
+	e := s.errors[code]
+	e.collected = true
+	s.errors[code] = e
+	atomic.AddUint64(&s.version, 1)
 	return s
 }
 
+// collectError records err and evicts the least recently seen errors beyond the limit.
+// The caller must hold the write lock.
+func (s *State) collectError(code string, severity Severity, err error) {
+	if s.errors == nil {
+		s.errors = make(Errors)
+	}
+	s.errors.collectAt(code, severity, err, s.now())
+	for s.maxErrors > 0 && len(s.errors) > s.maxErrors {
+		var oldest string
+		for c, e := range s.errors {
+			if c != code && (oldest == "" || e.LastSeen.Before(s.errors[oldest].LastSeen)) {
+				oldest = c
+			}
+		}
+		delete(s.errors, oldest)
+		s.evictedErrors++
+	}
+}
+
+// EvictedErrors returns the number of errors dropped because of the error limit.
+func (s *State) EvictedErrors() uint64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.evictedErrors
+}
+
 func (s *State) clearError(code string) *State {
 	s.mx.Lock()
 	defer s.mx.Unlock()
@@ -223,13 +1119,78 @@ func (s *State) clearError(code string) *State {
 	}
 	if _, found := s.errors[code]; found {
 		delete(s.errors, code)
+		atomic.AddUint64(&s.version, 1)
 	}
 	return s
 }
 
 func (s *State) getError(code string) error {
 	if err, found := s.errors[code]; found {
-		return err
+		return err.Err
 	}
 	return nil
 }
+
+// equal compares values with == unless they are of non comparable types (e.g. slices or maps)
+// which would make == panic
+func equal(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if reflect.TypeOf(a).Comparable() && reflect.TypeOf(b).Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// deepCopy copies maps and slices recursively so that the copy does not share memory with val.
+func deepCopy(val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	return copyValue(reflect.ValueOf(val)).Interface()
+}
+
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		return copyValue(v.Elem())
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), convert(copyValue(iter.Value()), v.Type().Elem()))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(convert(copyValue(v.Index(i)), v.Type().Elem()))
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+// convert makes v assignable to interface typed containers again after copyValue unwrapped it.
+func convert(v reflect.Value, t reflect.Type) reflect.Value {
+	if !v.IsValid() {
+		return reflect.Zero(t)
+	}
+	if v.Type() == t {
+		return v
+	}
+	c := reflect.New(t).Elem()
+	c.Set(v)
+	return c
+}
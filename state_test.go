@@ -2,8 +2,11 @@ package gockpit
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
@@ -61,9 +64,10 @@ func TestState_Apply(t *testing.T) {
 	}
 	mutation := s1.With()
 	mutation.mutation = s2
-	mutation.dirty = true
+	mutation.changes = DataChange
 	mutation.Apply()
 	assert.Equal(t, &State{
+		version: 1,
 		data: map[string]interface{}{
 			"A": "filled",
 			"B": 1,
@@ -80,3 +84,444 @@ func TestState_Apply(t *testing.T) {
 	require.NoError(t, err)
 	fmt.Println(string(js))
 }
+
+func TestState_MarshalVerboseErrors(t *testing.T) {
+	root := errors.New("connection refused")
+	s := &State{data: map[string]interface{}{}}
+	s.setError("db", SeverityError, fmt.Errorf("could not ping database: %w", root))
+
+	js, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.Contains(t, string(js), `"error":"could not ping database: connection refused"`)
+	assert.NotContains(t, string(js), `"chain"`)
+
+	s.verboseErrors = true
+	js, err = json.Marshal(s)
+	require.NoError(t, err)
+	assert.Contains(t, string(js), `"chain":["connection refused"]`)
+}
+
+func TestState_TypedGetters(t *testing.T) {
+	s := &State{data: map[string]interface{}{
+		"int":      1,
+		"int8":     int8(2),
+		"int32":    int32(3),
+		"int64":    int64(4),
+		"float32":  float32(1.5),
+		"float64":  2.5,
+		"bool":     true,
+		"string":   "text",
+		"dur":      1500 * time.Millisecond,
+		"dur.ns":   int64(2000),
+		"dur.str":  "1m30s",
+		"time":     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		"time.str": "2024-05-01T12:00:00Z",
+	}}
+	tests := []struct {
+		name     string
+		get      func(string) (interface{}, error)
+		key      string
+		expected interface{}
+		mismatch bool
+	}{
+		{"int", func(k string) (interface{}, error) { return s.GetInt(k) }, "int", 1, false},
+		{"int8", func(k string) (interface{}, error) { return s.GetInt(k) }, "int8", 2, false},
+		{"int32", func(k string) (interface{}, error) { return s.GetInt(k) }, "int32", 3, false},
+		{"int64", func(k string) (interface{}, error) { return s.GetInt(k) }, "int64", 4, false},
+		{"missing int", func(k string) (interface{}, error) { return s.GetInt(k) }, "missing", 0, false},
+		{"int mismatch", func(k string) (interface{}, error) { return s.GetInt(k) }, "string", 0, true},
+		{"float32", func(k string) (interface{}, error) { return s.GetFloat(k) }, "float32", 1.5, false},
+		{"float64", func(k string) (interface{}, error) { return s.GetFloat(k) }, "float64", 2.5, false},
+		{"missing float", func(k string) (interface{}, error) { return s.GetFloat(k) }, "missing", 0.0, false},
+		{"float mismatch", func(k string) (interface{}, error) { return s.GetFloat(k) }, "int", 0.0, true},
+		{"bool", func(k string) (interface{}, error) { return s.GetBool(k) }, "bool", true, false},
+		{"missing bool", func(k string) (interface{}, error) { return s.GetBool(k) }, "missing", false, false},
+		{"bool mismatch", func(k string) (interface{}, error) { return s.GetBool(k) }, "float64", false, true},
+		{"duration", func(k string) (interface{}, error) { return s.GetDuration(k) }, "dur", 1500 * time.Millisecond, false},
+		{"duration ns", func(k string) (interface{}, error) { return s.GetDuration(k) }, "dur.ns", 2 * time.Microsecond, false},
+		{"duration string", func(k string) (interface{}, error) { return s.GetDuration(k) }, "dur.str", 90 * time.Second, false},
+		{"missing duration", func(k string) (interface{}, error) { return s.GetDuration(k) }, "missing", time.Duration(0), false},
+		{"duration mismatch", func(k string) (interface{}, error) { return s.GetDuration(k) }, "string", time.Duration(0), true},
+		{"time", func(k string) (interface{}, error) { return s.GetTime(k) }, "time", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+		{"time string", func(k string) (interface{}, error) { return s.GetTime(k) }, "time.str", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), false},
+		{"missing time", func(k string) (interface{}, error) { return s.GetTime(k) }, "missing", time.Time{}, false},
+		{"time mismatch", func(k string) (interface{}, error) { return s.GetTime(k) }, "dur.str", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			val, err := tt.get(tt.key)
+			if tt.mismatch {
+				assert.True(t, errors.Is(err, ErrTypeMismatch))
+				assert.Contains(t, err.Error(), tt.key)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, val)
+		})
+	}
+	assert.Panics(t, func() { s.Int("string") })
+	assert.Panics(t, func() { s.Duration("bool") })
+	assert.Equal(t, 90*time.Second, s.Duration("dur.str"))
+	assert.Equal(t, 2024, s.Time("time.str").Year())
+}
+
+func TestState_Delete(t *testing.T) {
+	var notified []string
+	s := &State{data: map[string]interface{}{}}
+	s.alertNotifier = func(id string, a *Alert, active bool) {
+		notified = append(notified, fmt.Sprintf("%s=%t", id, active))
+	}
+	s.alerts = Alerts{
+		"peer:1":    NewBoolAlert(AlertStrategyClear),
+		"peer:2":    NewBoolAlert(AlertStrategyClear),
+		"peer:load": NewThresholdAlert("load", OpGreater, 1, AlertStrategyClear),
+		"load":      NewBoolAlert(AlertStrategyClear),
+	}
+	mutation := s.With()
+	mutation.Set("peer:1", true).Set("peer:2", true).Set("load", 2.0).SetError("peer:1", fmt.Errorf("timeout"))
+	mutation.Apply()
+	require.Error(t, s.Err("peer:1"))
+	s.alerts["peer:1"].acked = true
+	s.alerts["peer:load"].silencedUntil = time.Now().Add(time.Hour)
+
+	mutation = s.With()
+	mutation.Delete("peer:1").Delete("load")
+	assert.True(t, mutation.dirty())
+	mutation.Apply()
+	assert.Nil(t, s.Elem("peer:1"))
+	assert.NoError(t, s.Err("peer:1"))
+	require.Contains(t, s.alerts, "peer:1", "alerts stay registered")
+	assert.False(t, s.alerts["peer:1"].IsSet)
+	assert.False(t, s.alerts["peer:1"].acked)
+	assert.False(t, s.alerts["peer:load"].IsSet, "alerts watching the key under another ID are reset")
+	assert.Nil(t, s.alerts["peer:load"].silence(time.Now()))
+	assert.False(t, s.alerts["load"].IsSet)
+	assert.Equal(t, true, s.Elem("peer:2"))
+
+	// reset alerts resume once the keys come back
+	notified = nil
+	s.With().Set("peer:1", true).Set("load", 3.0).Apply()
+	assert.True(t, s.alerts["peer:1"].IsSet)
+	assert.True(t, s.alerts["peer:load"].IsSet)
+	assert.ElementsMatch(t, []string{"peer:1=true", "peer:load=true"}, notified)
+
+	s.Delete("peer:2")
+	assert.Nil(t, s.Elem("peer:2"))
+	assert.Len(t, s.alerts, 4)
+	assert.False(t, s.alerts["peer:2"].IsSet)
+}
+
+func TestState_Snapshot(t *testing.T) {
+	s := &State{alerts: Alerts{"temp": NewMaxFloatAlert(80, AlertStrategyClear)}}
+	mutation := s.With()
+	mutation.Set("temp", 90.0).Set("peers", map[string]interface{}{"a": []interface{}{1}}).SetError("net", errors.New("down"))
+	mutation.Apply()
+
+	data := s.Snapshot()
+	frozen := s.SnapshotState()
+	data["peers"].(map[string]interface{})["a"].([]interface{})[0] = 2
+	data["added"] = true
+	s.With().Set("temp", 20.0).SetError("net", nil).Apply()
+
+	assert.Equal(t, map[string]interface{}{"a": []interface{}{1}}, s.Elem("peers"))
+	assert.Nil(t, s.Elem("added"))
+	assert.Equal(t, 90.0, frozen.Float("temp"))
+	assert.Error(t, frozen.Err("net"))
+	assert.True(t, frozen.alerts["temp"].IsSet)
+	assert.False(t, s.alerts["temp"].IsSet)
+}
+
+func TestState_Prefix(t *testing.T) {
+	s := &State{}
+	s.With().Set("pool.active", 3).Set("pool.idle", 5).Set("poolSize", 8).Set("peers", []interface{}{"a"}).Apply()
+	assert.Equal(t, map[string]interface{}{"pool.active": 3, "pool.idle": 5}, s.Prefix("pool."))
+	assert.Equal(t, map[string]interface{}{"active": 3, "idle": 5}, s.Prefix("pool.", WithStrippedPrefix()))
+	assert.Empty(t, s.Prefix("disk."))
+
+	peers := s.Prefix("peers")
+	peers["peers"].([]interface{})[0] = "b"
+	assert.Equal(t, []interface{}{"a"}, s.Elem("peers"), "values are copied")
+}
+
+func TestState_ErrorHistory(t *testing.T) {
+	s := &State{}
+	errDown := errors.New("down")
+	for i := 0; i < 3; i++ {
+		s.With().SetError("net", errDown).Apply()
+	}
+	e, found := s.ErrorDetail("net")
+	require.True(t, found)
+	assert.Equal(t, 3, e.Count)
+	assert.False(t, e.FirstSeen.IsZero())
+	assert.False(t, e.LastSeen.Before(e.FirstSeen))
+	out, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"count":3,"firstSeen":`)
+
+	s.With().SetError("net", nil).Apply()
+	_, found = s.ErrorDetail("net")
+	assert.False(t, found)
+	s.With().SetError("net", errDown).Apply()
+	e, _ = s.ErrorDetail("net")
+	assert.Equal(t, 1, e.Count)
+}
+
+func TestErrors_Operations(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	errs := Errors{
+		"net":  {Err: errors.New("down"), Count: 2, FirstSeen: start, LastSeen: start.Add(time.Minute)},
+		"disk": {Err: errors.New("full"), Count: 1, FirstSeen: start, LastSeen: start, Severity: SeverityWarn},
+	}
+	assert.Equal(t, 2, errs.Len())
+	assert.Equal(t, []string{"disk", "net"}, errs.Codes())
+	warnings := errs.Filter(func(code string, e Error) bool {
+		return e.Severity < SeverityError
+	})
+	assert.Equal(t, []string{"disk"}, warnings.Codes())
+
+	errs.Merge(Errors{
+		"net": {Err: errors.New("timeout"), Count: 3, FirstSeen: start.Add(-time.Minute), LastSeen: start.Add(2 * time.Minute), Severity: SeverityCritical},
+		"cpu": {Err: errors.New("hot"), Count: 1, FirstSeen: start, LastSeen: start},
+	})
+	assert.Equal(t, []string{"cpu", "disk", "net"}, errs.Codes())
+	net := errs["net"]
+	assert.Equal(t, 5, net.Count)
+	assert.EqualError(t, net, "timeout")
+	assert.Equal(t, SeverityCritical, net.Severity)
+	assert.Equal(t, start.Add(-time.Minute), net.FirstSeen)
+	assert.Equal(t, start.Add(2*time.Minute), net.LastSeen)
+}
+
+func TestGet(t *testing.T) {
+	type peer struct {
+		Addr string
+	}
+	s := &State{}
+	s.With().Set("count", 3).Set("peer", peer{"10.0.0.1"}).Apply()
+
+	count, ok := Get[int](s, "count")
+	assert.True(t, ok)
+	assert.Equal(t, 3, count)
+	p, ok := Get[peer](s, "peer")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1", p.Addr)
+	f, ok := Get[float64](s, "count")
+	assert.False(t, ok)
+	assert.Zero(t, f)
+	_, ok = Get[string](s, "missing")
+	assert.False(t, ok)
+}
+
+func TestStateMutation_SetNonComparable(t *testing.T) {
+	s := &State{}
+	mutation := s.With()
+	mutation.Set("peers", []string{"a", "b"}).Set("labels", map[string]string{"host": "rpi"})
+	assert.True(t, mutation.dirty())
+	mutation.Apply()
+	assert.Equal(t, []string{"a", "b"}, s.Elem("peers"))
+
+	mutation = s.With()
+	mutation.Set("peers", []string{"a", "b"}).Set("labels", map[string]string{"host": "rpi"})
+	assert.False(t, mutation.dirty(), "equal slices and maps should not be a change")
+
+	mutation = s.With()
+	mutation.Set("peers", []string{"a"})
+	assert.True(t, mutation.dirty())
+	mutation = s.With()
+	mutation.Set("labels", 1)
+	assert.True(t, mutation.dirty())
+}
+
+func TestStateMutation_TypedSetters(t *testing.T) {
+	s := &State{}
+	s.With().SetInt("int", 3).SetFloat("float", 1.5).SetString("str", "on").SetBool("bool", true).SetDuration("dur", time.Minute).Apply()
+	assert.Equal(t, map[string]interface{}{"int": 3, "float": 1.5, "str": "on", "bool": true, "dur": time.Minute}, s.Snapshot())
+	assert.Equal(t, 3, s.Int("int"))
+	assert.Equal(t, 1.5, s.Float("float"))
+	assert.Equal(t, "on", s.String("str"))
+	assert.True(t, s.Bool("bool"))
+	assert.Equal(t, time.Minute, s.Duration("dur"))
+}
+
+func TestStateMutation_Group(t *testing.T) {
+	s := &State{}
+	s.With().SetGroup("pool", map[string]interface{}{"active": 3, "idle": 2}).Set("pooling", true).Apply()
+	assert.Equal(t, map[string]interface{}{"pool.active": 3, "pool.idle": 2, "pooling": true}, s.data)
+
+	s.With().SetGroup("pool", map[string]interface{}{"waiting": 1}).DeleteGroup("pool").Apply()
+	assert.Equal(t, map[string]interface{}{"pooling": true}, s.data)
+}
+
+func TestState_MarshalCSV(t *testing.T) {
+	s := &State{}
+	s.With().Set("b", 1.5).Set("a", "x,y").Set("c", struct{ On bool }{true}).Apply()
+	out, err := s.MarshalCSV()
+	require.NoError(t, err)
+	assert.Equal(t, "key,value\na,\"x,y\"\nb,1.5\nc,{true}\n", string(out))
+}
+
+func TestState_ConcurrentAccess(t *testing.T) {
+	// run with -race; the zero state must not be initialized by readers
+	s := &State{}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = s.Int("int")
+				_ = s.Float("float")
+				_ = s.Bool("bool")
+				_ = s.String("string")
+				_ = s.Elem("elem")
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.With().Set("int", i*j).Set("float", float64(j)).Set("bool", j%2 == 0).Set("string", "s").Set("elem", j).Apply()
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.NotNil(t, s.Elem("elem"))
+}
+
+func TestState_MarshalConcurrently(t *testing.T) {
+	// run with -race
+	s := &State{alerts: Alerts{"temp": NewMaxFloatAlert(80, AlertStrategyClear)}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			_, err := json.Marshal(s)
+			assert.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 100; j++ {
+			s.With().Set("temp", float64(j)).SetError(fmt.Sprintf("err%d", j%5), errors.New("failed")).Apply()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestState_MarshalLayout(t *testing.T) {
+	s := &State{alerts: Alerts{"temp": NewMaxFloatAlert(80, AlertStrategyClear)}}
+	s.With().Set("temp", 20.0).SetError("net", errors.New("down")).Apply()
+	s.errors["net"] = Error{Err: s.errors["net"].Err, Count: 1}
+
+	s.layout = &JSONLayout{Flat: true, ErrorsKey: "_errors", AlertsKey: "_alerts"}
+	out, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"temp":20,
+		"_errors":{"net":{"error":"down","count":1,"firstSeen":"0001-01-01T00:00:00Z","lastSeen":"0001-01-01T00:00:00Z","severity":"error"}},
+		"_alerts":{"temp":{"id":"temp","metric":"temp","active":false,"isSet":false,"firstOccurrence":"0001-01-01T00:00:00Z",
+			"lastOccurrence":"0001-01-01T00:00:00Z","message":"temp >= 80","severity":"error"}},
+		"meta":{"version":1}}`, string(out))
+
+	s.layout = &JSONLayout{StateKey: "metrics"}
+	s.With().SetError("net", nil).Apply()
+	out, err = json.Marshal(s)
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"metrics":{"temp":20}`)
+	assert.NotContains(t, string(out), `"errors"`)
+
+	s.layout = &JSONLayout{Flat: true}
+	s.With().Set("alerts", 1).Apply()
+	_, err = json.Marshal(s)
+	assert.True(t, errors.Is(err, ErrKeyCollision))
+}
+
+func TestStateMutation_Incr(t *testing.T) {
+	s := &State{}
+	s.With().IncrInt("count", 2).Incr("ratio", 0.5).Apply()
+	s.With().IncrInt("count", 3).Incr("ratio", 0.25).IncrInt("ratio", 1).Apply()
+	assert.Equal(t, 5, s.Int("count"))
+	assert.Equal(t, 1.75, s.Float("ratio"))
+
+	// increments of merged mutations add up
+	first, second := s.With().IncrInt("count", 1), s.With().IncrInt("count", 1)
+	mutation := s.With()
+	mutation.merge(first)
+	mutation.merge(second)
+	mutation.Apply()
+	assert.Equal(t, 7, s.Int("count"))
+
+	s.With().Set("count", 10).IncrInt("count", 1).Apply()
+	assert.Equal(t, 11, s.Int("count"))
+
+	s.With().Set("name", "rpi").Apply()
+	s.With().IncrInt("name", 1).Apply()
+	assert.Equal(t, "rpi", s.String("name"))
+	assert.True(t, errors.Is(s.Err("name"), ErrTypeMismatch))
+}
+
+func TestState_UnmarshalJSON(t *testing.T) {
+	s := &State{alerts: Alerts{"hot": NewThresholdAlert("temp", OpGreater, 80, AlertStrategyClear)}}
+	s.With().
+		Set("temp", 90.5).
+		Set("count", 3).
+		Set("config", map[string]interface{}{"retries": 2, "hosts": []interface{}{"a", "b"}}).
+		SetError("net", errors.New("down")).
+		Apply()
+	out, err := json.Marshal(s)
+	require.NoError(t, err)
+
+	restored := &State{}
+	require.NoError(t, json.Unmarshal(out, restored))
+	assert.Equal(t, s.Snapshot(), restored.Snapshot())
+	assert.Equal(t, 3, restored.Int("count"))
+	assert.EqualError(t, restored.Err("net"), "down")
+	detail, _ := restored.ErrorDetail("net")
+	assert.Equal(t, 1, detail.Count)
+	assert.True(t, s.errors["net"].FirstSeen.Equal(detail.FirstSeen))
+	require.Contains(t, restored.alerts, "hot")
+	assert.True(t, restored.alerts["hot"].IsSet)
+	assert.Equal(t, "temp > 80", restored.alerts["hot"].Message())
+
+	again, err := json.Marshal(restored)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(out), string(again))
+	// restored alerts keep their status
+	restored.With().Set("temp", 20).Apply()
+	assert.True(t, restored.alerts["hot"].IsSet)
+
+	flat := &State{layout: &JSONLayout{Flat: true}}
+	require.NoError(t, json.Unmarshal([]byte(`{"temp":20,"ratio":0.5,"errors":{"net":{"error":"down","count":2}}}`), flat))
+	assert.Equal(t, map[string]interface{}{"temp": 20, "ratio": 0.5}, flat.Snapshot())
+	assert.EqualError(t, flat.Err("net"), "down")
+}
+
+func TestState_Version(t *testing.T) {
+	s := &State{}
+	assert.Zero(t, s.Version())
+	s.With().Set("a", 1).Apply()
+	s.With().Set("a", 1).Apply()
+	assert.EqualValues(t, 1, s.Version(), "unchanged values should not bump the version")
+	s.With().SetError("a", errors.New("failed")).Apply()
+	s.Delete("a")
+	assert.EqualValues(t, 3, s.Version())
+
+	out, err := json.Marshal(s)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"state":{},"meta":{"version":3}}`, string(out))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.With().Set("a", i+1).Apply()
+		}(i)
+	}
+	prev := s.Version()
+	for i := 0; i < 100; i++ {
+		v := s.Version()
+		assert.GreaterOrEqual(t, v, prev)
+		prev = v
+	}
+	wg.Wait()
+}
@@ -0,0 +1,63 @@
+package gockpit
+
+import "time"
+
+// SamplerStats aggregates statistics of the supervisor sampling loop.
+type SamplerStats struct {
+	Ticks           uint64        `json:"ticks"`
+	DroppedTicks    uint64        `json:"droppedTicks"`
+	ProbesRun       uint64        `json:"probesRun"`
+	ProbesSkipped   uint64        `json:"probesSkipped"`
+	AvgTickDuration time.Duration `json:"avgTickDuration"`
+	MaxTickDuration time.Duration `json:"maxTickDuration"`
+	LastTick        time.Time     `json:"lastTick"`
+	DroppedPushes   uint64        `json:"droppedPushes"`
+	DroppedSaves    uint64        `json:"droppedSaves"`
+	EvictedErrors   uint64        `json:"evictedErrors"`
+	// DroppedUpdates counts notifications dropped by asynchronous listeners falling behind
+	// keyed by listener.<id>
+	DroppedUpdates map[string]uint64 `json:"droppedUpdates,omitempty"`
+	StartTime      time.Time         `json:"startTime"`
+	Uptime         time.Duration     `json:"uptime"`
+	totalDuration  time.Duration
+}
+
+func (st *SamplerStats) record(now time.Time, duration, interval time.Duration, run, skipped int) {
+	if !st.LastTick.IsZero() && interval > 0 {
+		// ticker drops ticks for slow receivers; gaps of up to 1.5 interval are regarded as jitter
+		if gap := now.Sub(st.LastTick); gap > interval*3/2 {
+			st.DroppedTicks += uint64((gap+interval/2)/interval - 1)
+		}
+	}
+	st.Ticks++
+	st.ProbesRun += uint64(run)
+	st.ProbesSkipped += uint64(skipped)
+	st.totalDuration += duration
+	st.AvgTickDuration = st.totalDuration / time.Duration(st.Ticks)
+	if duration > st.MaxTickDuration {
+		st.MaxTickDuration = duration
+	}
+	st.LastTick = now
+}
+
+func (st *SamplerStats) meta() *runMeta {
+	return &runMeta{
+		StartTime:    st.StartTime,
+		Ticks:        st.Ticks,
+		DroppedTicks: st.DroppedTicks,
+	}
+}
+
+// runMeta describes the sampling loop in the reserved meta section of the state.
+type runMeta struct {
+	StartTime    time.Time     `json:"startTime"`
+	Uptime       time.Duration `json:"uptime"`
+	Ticks        uint64        `json:"ticks"`
+	DroppedTicks uint64        `json:"droppedTicks"`
+}
+
+func (m *runMeta) at(now time.Time) *runMeta {
+	meta := *m
+	meta.Uptime = now.Sub(m.StartTime)
+	return &meta
+}
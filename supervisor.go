@@ -3,33 +3,152 @@ package gockpit
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 var defaultSamplingInterval = time.Second
 
+// minSamplingInterval guards against loops spinning the CPU
+const minSamplingInterval = time.Millisecond
+
+var (
+	ErrUnknownMetric = fmt.Errorf("unknown metric")
+	ErrNoReader      = fmt.Errorf("store does not implement gockpit.Reader")
+	ErrNoNameInverse = fmt.Errorf("name transformer has no inverse")
+	// ErrDependencyCycle is returned by AddProbeAfter for probes depending on themselves
+	ErrDependencyCycle = fmt.Errorf("probe dependency cycle")
+)
+
+// StoreErrorCode is the error code under which store failures are reported in the state.
+const StoreErrorCode = "gockpit.store"
+
+// TickErrorCode is the error code under which a panic of a sampling pass is reported in the state.
+// It is resolved by the next pass that completes.
+const TickErrorCode = "gockpit.tick"
+
+const (
+	storeBucket      = "gockpit"
+	shutdownSuffix   = ".shutdown"
+	storeSaveTimeout = 5 * time.Second
+	storeBackoffMin  = time.Second
+	storeBackoffMax  = time.Minute
+	storeQueueSize   = 16
+)
+
+const probeCloseTimeout = 5 * time.Second
+
 type Probe interface {
 	UpdateState(context.Context, *StateMutation)
 }
 
 type ProbeFunc func(context.Context, *StateMutation)
 
+func (f ProbeFunc) UpdateState(ctx context.Context, mutation *StateMutation) {
+	f(ctx, mutation)
+}
+
+// ProbeGroup is a set of related probes sampled within the same scheduling slot. Members run one
+// after another in the order of their names sharing the context and the mutation, e.g. so that
+// they can reuse a connection opened for the tick. A panicking member is reported under its name.
+type ProbeGroup map[string]Probe
+
+func (g ProbeGroup) UpdateState(ctx context.Context, mutation *StateMutation) {
+	names := make([]string, 0, len(g))
+	for name := range g {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g.sample(ctx, name, mutation)
+	}
+}
+
+func (g ProbeGroup) sample(ctx context.Context, name string, mutation *StateMutation) {
+	defer func() {
+		if r := recover(); r != nil {
+			mutation.SetError(name, fmt.Errorf("probe %s panicked: %v", name, r))
+		}
+	}()
+	g[name].UpdateState(ctx, mutation)
+}
+
+// Close closes members implementing io.Closer and returns the first error.
+func (g ProbeGroup) Close() error {
+	var first error
+	for _, p := range g {
+		c, ok := p.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ErrProbeFunc is a probe returning sampled values instead of setting them. Returned error is
+// reported under the metric name and nil error resolves it. Values are ignored on error.
+type ErrProbeFunc func(context.Context) (map[string]interface{}, error)
+
 type Listener func(*State)
 
+// ErrListener is a listener reporting its failures, e.g. of a push, to the supervisor.
+type ErrListener func(*State) error
+
+// ChangeListener is a listener receiving transitions of values; see AddChangeListener.
+type ChangeListener func(*State, []ChangeEvent)
+
+// KeysListener is a listener receiving keys whose values have changed.
+type KeysListener func(*State, []string)
+
+// CtxListener is a listener receiving the context the supervisor runs with.
+// The context is cancelled on Stop so that long running listeners can abort.
+type CtxListener func(context.Context, *State)
+
+// Point is a persisted sample of a measurement.
+type Point struct {
+	Time   time.Time              `json:"time"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// Reader is implemented by stores able to query persisted measurements.
 type Reader interface {
+	// Query returns points of the measurement saved within the since period ordered by time.
+	// Zero since means no limit.
+	Query(ctx context.Context, bucket, name string, since time.Duration) ([]Point, error)
 }
 
+// Writer saves state snapshots. Fields passed to Save are a deep copy of the state
+// owned by the writer so that they may be retained, e.g. by a batching writer.
 type Writer interface {
 	Save(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error
 }
 
+// PointWriter is implemented by stores able to save points with explicit timestamps. When the store
+// implements it the state is saved as points: values set with StateMutation.SetAt at their timestamps
+// and all other values at the time of the tick. Plain writers save all values together.
+type PointWriter interface {
+	SavePoints(ctx context.Context, bucket, name string, points []Point, tags map[string]string) error
+}
+
 type ReadWriter interface {
 	Reader
 	Writer
@@ -39,69 +158,524 @@ type Metric struct {
 	name       string
 	interval   time.Duration
 	lastUpdate time.Time
+	// firstRun delays the first sampling of a jittered metric
+	firstRun   time.Time
 	probe      interface{}
+	retries    int
+	backoff    time.Duration
+	timeout    time.Duration
+	valueRange *Range
+	status     MetricStatus
+	logger     *zerolog.Logger
+	// after lists metrics sampled before this one within a tick
+	after []string
+	// closed is set once Stop has closed the probe which is not sampled anymore
+	closed bool
 }
 
-func NewMetric(name string, interval time.Duration, probe interface{}) *Metric {
-	switch t := probe.(type) {
-	case Probe:
-	case ProbeFunc:
-	default:
-		panic(fmt.Errorf("invalid metric probe of type %s; one of gockpit.Probe, gockpit.ProbeFunc is expected", t))
+// MetricStatus tells how the last sampling of a metric went.
+type MetricStatus string
+
+const (
+	// MetricHealthy metrics reported no error
+	MetricHealthy MetricStatus = "healthy"
+	// MetricDegraded metrics reported an error along with some values
+	MetricDegraded MetricStatus = "degraded"
+	// MetricFailed metrics reported an error and no values
+	MetricFailed MetricStatus = "failed"
+	// MetricSkipped metrics were left out of the last pass because its tick budget ran out
+	MetricSkipped MetricStatus = "skipped"
+)
+
+// statusOf derives the status of the metric from its sampling results
+func statusOf(name string, mutation *StateMutation) MetricStatus {
+	if !mutation.failed(name) {
+		return MetricHealthy
+	}
+	if len(mutation.mutation.data) > 0 || len(mutation.increments) > 0 {
+		return MetricDegraded
+	}
+	return MetricFailed
+}
+
+// Range describes expected values of a metric; warn and crit are thresholds dashboards may use for highlighting.
+type Range struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Warn float64 `json:"warn"`
+	Crit float64 `json:"crit"`
+}
+
+// MetricSchema is a description of a registered metric.
+type MetricSchema struct {
+	Name     string        `json:"name"`
+	Interval time.Duration `json:"interval"`
+	Range    *Range        `json:"range,omitempty"`
+}
+
+// MetricInfo describes sampling of a registered metric.
+type MetricInfo struct {
+	Name       string        `json:"name"`
+	Interval   time.Duration `json:"interval"`
+	LastUpdate time.Time     `json:"lastUpdate"`
+	// Status is empty until the metric is sampled
+	Status MetricStatus `json:"status,omitempty"`
+}
+
+type MetricOption func(*Metric)
+
+// RetriesPerTick makes the supervisor sample a failing probe up to n more times within the same tick,
+// waiting backoff between attempts. Sampling is considered failed when the probe reports an error
+// under the metric name. Only the outcome of the last attempt is recorded.
+func RetriesPerTick(n int, backoff time.Duration) MetricOption {
+	return func(metric *Metric) {
+		metric.retries = n
+		metric.backoff = backoff
+	}
+}
+
+// Timeout limits the time the supervisor waits for the probe. When exceeded, the probe context
+// is cancelled and a timeout error is recorded under the metric name. A probe ignoring its context
+// cannot be forcibly stopped; it keeps running in the background while its results are discarded.
+func Timeout(d time.Duration) MetricOption {
+	return func(metric *Metric) {
+		metric.timeout = d
+	}
+}
+
+// ExpectedRange declares the range of values expected from the metric. It is purely descriptive.
+func ExpectedRange(min, max, warn, crit float64) MetricOption {
+	return func(metric *Metric) {
+		metric.valueRange = &Range{Min: min, Max: max, Warn: warn, Crit: crit}
 	}
-	return &Metric{
+}
+
+func NewMetric(name string, interval time.Duration, probe interface{}, opts ...MetricOption) *Metric {
+	if err := validateProbe(probe); err != nil {
+		panic(err)
+	}
+	m := &Metric{
 		name:     name,
 		probe:    probe,
 		interval: interval,
+		logger:   &log.Logger,
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	return m
+}
+
+func validateProbe(probe interface{}) error {
+	switch t := probe.(type) {
+	case nil:
+		// values of external metrics are pushed rather than sampled
+	case Probe:
+	case ErrProbeFunc:
+	default:
+		return fmt.Errorf("invalid metric probe of type %T; one of gockpit.Probe, gockpit.ProbeFunc, gockpit.ErrProbeFunc or nil is expected", t)
+	}
+	return nil
+}
+
+// due tells if the metric should be sampled. Ticks earlier than the interval by less than slack are
+// accepted so that ticker jitter does not make a metric skip the tick matching its interval.
+func (mg *Metric) due(now time.Time, slack time.Duration) bool {
+	if mg.lastUpdate.IsZero() && !mg.firstRun.IsZero() {
+		return !now.Before(mg.firstRun)
+	}
+	if mg.lastUpdate.IsZero() {
+		return true
+	}
+	return !now.Add(slack).Before(mg.lastUpdate.Add(mg.interval))
+}
+
+func (mg *Metric) updateState(ctx context.Context, mutation *StateMutation) {
+	for i := 0; i < mg.retries; i++ {
+		attempt := mutation.state.With()
+		mg.sample(ctx, attempt)
+		if !attempt.failed(mg.name) {
+			mutation.merge(attempt)
+			return
+		}
+		select {
+		case <-time.After(mg.backoff):
+		case <-ctx.Done():
+			mutation.merge(attempt)
+			return
+		}
 	}
+	mg.sample(ctx, mutation)
 }
 
-func (mg *Metric) updateState(ctx context.Context, now time.Time, mutation *StateMutation) {
-	if !now.After(mg.lastUpdate.Add(mg.interval)) {
+func (mg *Metric) sample(ctx context.Context, mutation *StateMutation) {
+	if mg.timeout <= 0 {
+		mg.invoke(ctx, mutation)
 		return
 	}
+	ctx, cancel := context.WithTimeout(ctx, mg.timeout)
+	defer cancel()
+	// the probe writes into its own mutation so that an abandoned probe cannot touch the tick
+	attempt := mutation.state.With()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mg.invoke(ctx, attempt)
+	}()
+	select {
+	case <-done:
+		mutation.merge(attempt)
+	case <-ctx.Done():
+		mutation.SetError(mg.name, fmt.Errorf("probe %s did not finish: %w", mg.name, ctx.Err()))
+	}
+}
+
+func (mg *Metric) invoke(ctx context.Context, mutation *StateMutation) {
+	defer func() {
+		if r := recover(); r != nil {
+			mg.logger.Error().Interface("panic", r).Str("metric", mg.name).Msg("probe panicked")
+			mutation.SetError(mg.name, fmt.Errorf("probe %s panicked: %v", mg.name, r))
+		}
+	}()
 	switch p := mg.probe.(type) {
 	case Probe:
 		p.UpdateState(ctx, mutation)
-	case ProbeFunc:
-		// probe functions do not provide a possibility to copy errors
-		// during sampling
-		p(ctx, mutation)
+	case ErrProbeFunc:
+		values, err := p(ctx)
+		mutation.SetError(mg.name, err)
+		if err != nil {
+			return
+		}
+		for key, val := range values {
+			mutation.Set(key, val)
+		}
 	}
 }
 
 type Supervisor struct {
 	mx               sync.Mutex
+	logger           *zerolog.Logger
+	clock            Clock
 	metrics          map[string]*Metric
 	state            *State
-	listeners        []Listener
-	store            ReadWriter
+	listenersMx      sync.Mutex
+	listeners        []listener
+	nextListenerID   uint64
+	listenerBuffer   int
+	debounce         *debouncer
+	store            Writer
 	name             string
 	samplingInterval time.Duration
-	cancel           func()
+	significantKeys  map[string]bool
+	maxStaleness     time.Duration
+	lastSave         time.Time
+	storeTimeout     time.Duration
+	closeTimeout     time.Duration
+	probesClosed     bool
+	cleanShutdown    bool
+	lastShutdown     time.Time
+	stats            SamplerStats
+	deltas           map[string]string
+	derived          map[string]func(*State) interface{}
+	pushLimit        *pushLimiter
+	tags             map[string]string
+	healthCodes      map[string]bool
+	probeJitter      float64
+	restoreOnStart   bool
+	middlewares      []func(http.Handler) http.Handler
+	wsOrigins        []string
+	persistErrors    bool
+	tickBudget       time.Duration
+	nameTransformer  func(string) string
+	nameInverse      func(string) string
+	// adaptiveTick is the minimum loop tick derived from metric intervals; zero disables adaptive sampling
+	adaptiveTick    time.Duration
+	persistInterval time.Duration
+	aggregations    []Aggregation
+	// window aggregates numeric values sampled since the last save
+	window persistWindow
+	// significantChanged is set when a significant key changes and reset on save
+	significantChanged bool
+	// stalled holds probes abandoned by a pass that exceeded the tick budget and still running
+	stalled map[string]bool
+	// runMx guards the sampling loop lifecycle; it is separate from mx so that
+	// the loop may be stopped while a tick holds mx
+	runMx  sync.Mutex
+	ctx    context.Context
+	cancel func()
+	// done is closed when the sampling loop exits
+	done chan struct{}
+	// sampling serializes sampling passes of the loop and the ones forced with SampleNow
+	sampling sync.Mutex
+	// phase of the sampling pass in progress reported on panic; guarded by sampling
+	phase string
+	// reconfigure signals the sampling loop that the interval has changed
+	reconfigure chan struct{}
+	// saves queues snapshots for the store while the sampling loop is running
+	saves chan savedState
+	// backoffMx guards the store backoff; the saver draining the queue on exit may race with
+	// saves of forced passes done synchronously
+	backoffMx     sync.Mutex
+	storeFailures int
+	storeRetryAt  time.Time
 }
 
 type SupervisorOption func(*Supervisor)
 
-func WithStore(store ReadWriter) SupervisorOption {
+// WithStore makes the supervisor persist its state in the store. Stores implementing
+// Reader additionally allow restoring information about previous runs.
+func WithStore(store Writer) SupervisorOption {
 	return func(supervisor *Supervisor) {
 		supervisor.store = store
 	}
 }
 
+// WithStoreTimeout sets the timeout of a single save. Default is 5 seconds.
+func WithStoreTimeout(timeout time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.storeTimeout = timeout
+	}
+}
+
+// WithProbeCloseTimeout sets how long Stop waits for probes to close. Default is 5 seconds.
+func WithProbeCloseTimeout(timeout time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.closeTimeout = timeout
+	}
+}
+
+// WithProbeJitter delays the first sampling of every probe by a random fraction (0-1) of its interval.
+// It spreads sampling of probes sharing the same interval across ticks.
+func WithProbeJitter(fraction float64) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.probeJitter = math.Min(math.Max(fraction, 0), 1)
+	}
+}
+
+// WithRestoreOnStart makes NewSupervisor restore the last persisted state from the store.
+// The store has to implement Reader; see Restore for details.
+func WithRestoreOnStart() SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.restoreOnStart = true
+	}
+}
+
+// WithTags sets static tags (e.g. host or environment) passed to the store with every save.
+func WithTags(tags map[string]string) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			supervisor.tags[k] = v
+		}
+	}
+}
+
+// WithPersistedErrors makes the supervisor save active errors and alerts together with the state.
+// Every error is saved as error.<code> field holding its occurrence count and every alert
+// as alert.<id> field telling if the alert is set.
+func WithPersistedErrors() SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.persistErrors = true
+	}
+}
+
+// WithHealthErrorCodes limits errors making /health report failure to the given codes.
+// By default any error is considered fatal.
+func WithHealthErrorCodes(codes []string) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.healthCodes = make(map[string]bool, len(codes))
+		for _, code := range codes {
+			supervisor.healthCodes[code] = true
+		}
+	}
+}
+
+// WithSamplingInterval sets the tick of the sampling loop. Metrics are sampled at most once per tick.
+// Intervals below a millisecond are clamped.
 func WithSamplingInterval(interval time.Duration) SupervisorOption {
 	return func(supervisor *Supervisor) {
 		supervisor.samplingInterval = interval
 	}
 }
 
+// WithAdaptiveSampling makes the sampling loop tick as often as the metric with the shortest
+// interval requires (but never less often than the sampling interval) so that fast metrics are
+// sampled at their requested rate. The tick is not shorter than minTick.
+func WithAdaptiveSampling(minTick time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		if minTick < minSamplingInterval {
+			minTick = minSamplingInterval
+		}
+		supervisor.adaptiveTick = minTick
+	}
+}
+
+// WithSignificantKeys limits persistence to ticks in which at least one of the given keys
+// has changed. Changes of other keys are considered noise. State is still saved when
+// it has not been persisted for longer than maxStaleness (zero disables the fallback).
+func WithSignificantKeys(maxStaleness time.Duration, keys ...string) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.maxStaleness = maxStaleness
+		supervisor.significantKeys = make(map[string]bool, len(keys))
+		for _, k := range keys {
+			supervisor.significantKeys[k] = true
+		}
+	}
+}
+
+// WithPersistInterval decouples persistence from sampling: the state is saved at most once per
+// interval, on the first tick after it elapses, holding the latest values. Like with per tick
+// persistence the state is saved whether it has changed or not, i.e. the dirty flag of the tick is
+// not considered. With WithSignificantKeys the save is made only if a significant key has changed
+// at any tick since the previous save or the staleness limit has been reached.
+func WithPersistInterval(interval time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.persistInterval = interval
+	}
+}
+
+// WithPersistAggregation makes the supervisor save aggregations of numeric values sampled
+// since the previous save as <key>.<aggregation> fields next to the latest values.
+// It is meant to be used with WithPersistInterval.
+func WithPersistAggregation(aggs ...Aggregation) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.aggregations = aggs
+	}
+}
+
+// IdentityName is the default name transformer keeping names unchanged.
+func IdentityName(name string) string {
+	return name
+}
+
+// WithNameTransformer makes the supervisor rename keys emitted to the store and the Prometheus
+// endpoint, e.g. to follow naming conventions of the backend. The state keeps canonical names:
+// History looks metrics up by their transformed names and Restore maps stored names back with
+// inverse. Restore fails with ErrNoNameInverse if inverse is nil.
+func WithNameTransformer(transform, inverse func(string) string) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.nameTransformer = transform
+		supervisor.nameInverse = inverse
+	}
+}
+
+// WithHistogramWindow sets the period summarized by histograms fed with StateMutation.Observe.
+// Histograms start over once it elapses. Default is one minute.
+func WithHistogramWindow(window time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.state.histogramWindow = window
+	}
+}
+
+// WithVerboseErrors makes the state render the full chain of wrapped errors in its JSON representation.
+func WithVerboseErrors() SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.state.verboseErrors = true
+	}
+}
+
+// WithClock makes the supervisor sample, evaluate alerts, silence them, stamp errors, close
+// push limit windows and debounce listeners following clock instead of the system time.
+func WithClock(clock Clock) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.clock = clock
+		supervisor.state.clock = clock
+	}
+}
+
+// WithLogger makes the supervisor log with logger instead of the global zerolog logger.
+func WithLogger(logger *zerolog.Logger) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.logger = logger
+	}
+}
+
+// WithTickBudget limits the time a sampling pass may take. Probes still running once the budget
+// is exceeded are logged and reported as failed, and the pass completes without waiting for them
+// so that a wedged probe does not stall the sampling loop, SampleNow and Stop. Abandoned probes
+// are not sampled again until they return and their late results are dropped. Probes registered
+// with AddProbeAfter whose level has not started by then are reported as skipped and sampled
+// in the next pass.
+func WithTickBudget(budget time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.tickBudget = budget
+	}
+}
+
+// WithHTTPMiddleware adds middlewares (e.g. authentication) applied to all routes of HTTPHandler.
+func WithHTTPMiddleware(middlewares ...func(http.Handler) http.Handler) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.middlewares = append(supervisor.middlewares, middlewares...)
+	}
+}
+
+// WithWebsocketOrigins allows pages served from hosts matching patterns (see filepath.Match), e.g.
+// a dashboard hosted elsewhere, to open the state websocket. Since the socket accepts control
+// commands, only connections from the host serving it are accepted by default.
+func WithWebsocketOrigins(patterns ...string) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.wsOrigins = append(supervisor.wsOrigins, patterns...)
+	}
+}
+
+// WithJSONLayout changes the way the state is rendered by MarshalJSON and the HTTP handler.
+func WithJSONLayout(layout JSONLayout) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.state.layout = &layout
+	}
+}
+
+// WithMaxErrors keeps at most n errors in the state evicting the least recently seen ones,
+// e.g. when error codes are of high cardinality. Evictions are counted in Stats.
+func WithMaxErrors(n int) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.state.maxErrors = n
+	}
+}
+
+// WithAlertNotifier registers a notifier called whenever an alert gets set or cleared.
+func WithAlertNotifier(notifier AlertNotifier) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.state.alertNotifier = notifier
+	}
+}
+
+// WithListenerDebounce makes the supervisor notify listeners at most once per interval.
+// Changes within the interval are coalesced and listeners receive the trailing state unless
+// the supervisor is stopped before the interval ends. Persistence is not affected.
+func WithListenerDebounce(interval time.Duration) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		supervisor.debounce = &debouncer{interval: interval}
+	}
+}
+
+// WithAsyncListeners makes the supervisor notify every listener from its own goroutine so that
+// a slow listener delays neither other listeners nor sampling. Up to buffer notifications are queued
+// per listener; once it falls behind, the oldest queued notification is dropped and its keys are
+// carried over to the next one. Listeners always read the latest state. Dropped notifications
+// are counted per listener in SamplerStats.DroppedUpdates.
+func WithAsyncListeners(buffer int) SupervisorOption {
+	return func(supervisor *Supervisor) {
+		if buffer < 1 {
+			buffer = 1
+		}
+		supervisor.listenerBuffer = buffer
+	}
+}
+
 func NewSupervisor(name string, opts ...SupervisorOption) *Supervisor {
 	s := &Supervisor{
-		name:    name,
-		metrics: make(map[string]*Metric),
+		name:        name,
+		metrics:     make(map[string]*Metric),
+		stalled:     make(map[string]bool),
+		reconfigure: make(chan struct{}, 1),
 		state: &State{
 			data: make(map[string]interface{}),
 		},
+		logger:          &log.Logger,
+		clock:           realClock{},
+		nameTransformer: IdentityName,
+		nameInverse:     IdentityName,
 	}
 	for _, o := range opts {
 		o(s)
@@ -109,6 +683,28 @@ func NewSupervisor(name string, opts ...SupervisorOption) *Supervisor {
 	if s.samplingInterval == 0 {
 		s.samplingInterval = defaultSamplingInterval
 	}
+	if s.samplingInterval < minSamplingInterval {
+		s.samplingInterval = minSamplingInterval
+	}
+	if s.storeTimeout <= 0 {
+		s.storeTimeout = storeSaveTimeout
+	}
+	if s.closeTimeout <= 0 {
+		s.closeTimeout = probeCloseTimeout
+	}
+	if s.pushLimit != nil {
+		s.pushLimit.clock = s.clock
+	}
+	if s.debounce != nil {
+		s.debounce.clock = s.clock
+	}
+	if s.restoreOnStart {
+		ctx, cancel := context.WithTimeout(context.Background(), s.storeTimeout)
+		if err := s.Restore(ctx); err != nil {
+			s.logger.Error().Err(err).Msg("could not restore state")
+		}
+		cancel()
+	}
 	return s
 }
 
@@ -116,96 +712,1659 @@ func (s *Supervisor) GetState() *State {
 	return s.state
 }
 
+// Errors returns a copy of unresolved errors.
 func (s *Supervisor) Errors() Errors {
-	return s.state.errors
+	s.state.mx.RLock()
+	defer s.state.mx.RUnlock()
+	errs := make(Errors, len(s.state.errors))
+	errs.Merge(s.state.errors)
+	return errs
 }
 
-func (s *Supervisor) AddProbe(name string, interval time.Duration, p interface{}) {
+// AddProbe registers a probe sampled every interval. A nil probe registers an external metric
+// which is listed with other metrics but never sampled; its values come from Push or CollectError.
+func (s *Supervisor) AddProbe(name string, interval time.Duration, p interface{}, opts ...MetricOption) {
+	m := NewMetric(name, interval, p, opts...)
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	s.metrics[name] = NewMetric(name, interval, p)
+	s.jitter(m, s.clock.Now())
+	m.logger = s.logger
+	s.metrics[name] = m
+	s.retick()
 }
 
-func (s *Supervisor) AddAlert(ID string, a *Alert) {
+// AddProbeNow registers a probe like AddProbe and samples it right away so that its value is available
+// before the next tick. The sample waits for a sampling pass of the loop that is in progress and counts
+// as the latest run of the probe, so the loop samples it again one interval later. Listeners are
+// notified and the state is persisted like after a regular tick.
+func (s *Supervisor) AddProbeNow(ctx context.Context, name string, interval time.Duration, p interface{}, opts ...MetricOption) {
+	s.sampling.Lock()
+	defer s.sampling.Unlock()
+	s.AddProbe(name, interval, p, opts...)
+	s.sample(ctx, s.clock.Now(), true, name)
+}
+
+// AddProbeAfter registers a probe like AddProbe that runs after the probes named in deps whenever
+// they are sampled within the same tick, so that it may derive values from theirs. Dependencies
+// do not have to be registered yet. A probe that would introduce a dependency cycle is rejected.
+func (s *Supervisor) AddProbeAfter(name string, deps []string, interval time.Duration, p interface{}, opts ...MetricOption) error {
+	m := NewMetric(name, interval, p, opts...)
+	m.after = deps
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	if s.state.alerts == nil {
-		s.state.alerts = make(Alerts)
+	for _, dep := range deps {
+		if dep == name || s.dependsOn(dep, name, map[string]bool{}) {
+			return fmt.Errorf("%w: %s cannot run after %s", ErrDependencyCycle, name, dep)
+		}
 	}
-	s.state.alerts[ID] = a
+	s.jitter(m, s.clock.Now())
+	m.logger = s.logger
+	s.metrics[name] = m
+	s.retick()
+	return nil
+}
+
+// dependsOn tells if metric name runs after target directly or transitively
+func (s *Supervisor) dependsOn(name, target string, visited map[string]bool) bool {
+	m, found := s.metrics[name]
+	if !found || visited[name] {
+		return false
+	}
+	visited[name] = true
+	for _, dep := range m.after {
+		if dep == target || s.dependsOn(dep, target, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddProbeGroup registers probes sampled together every interval as a single metric.
+func (s *Supervisor) AddProbeGroup(name string, interval time.Duration, probes map[string]Probe, opts ...MetricOption) {
+	s.AddProbe(name, interval, ProbeGroup(probes), opts...)
+}
+
+// ProbeSpec describes a probe registered with AddProbes.
+type ProbeSpec struct {
+	Interval time.Duration
+	Probe    interface{}
+	Options  []MetricOption
 }
 
-func (s *Supervisor) AddListener(l Listener) {
+// AddProbes registers all probes at once so that a tick never samples a partially registered set.
+func (s *Supervisor) AddProbes(specs map[string]ProbeSpec) {
+	// invalid probes panic before anything gets registered
+	metrics := make(map[string]*Metric, len(specs))
+	for name, spec := range specs {
+		metrics[name] = NewMetric(name, spec.Interval, spec.Probe, spec.Options...)
+	}
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	s.listeners = append(s.listeners, l)
+	now := s.clock.Now()
+	for name, m := range metrics {
+		s.jitter(m, now)
+		m.logger = s.logger
+		s.metrics[name] = m
+	}
+	s.retick()
 }
 
-func (s *Supervisor) Run(ctx context.Context) {
-	ctx, s.cancel = context.WithCancel(ctx)
-	go func() {
-		ticker := time.NewTicker(s.samplingInterval)
-		defer ticker.Stop()
-		for {
-			select {
-			case now := <-ticker.C:
-				s.mx.Lock()
-				mutation := s.state.With()
-
-				for _, mg := range s.metrics {
-					if now.After(mg.lastUpdate.Add(mg.interval)) {
-						mg.updateState(ctx, now, mutation)
-						mg.lastUpdate = now
-					} else {
-						// copy previous error
-						if err := s.state.getError(mg.name); err != nil {
-							mutation.SetError(mg.name, err)
-						}
-					}
-				}
-				mutation.Apply()
-				if mutation.dirty {
-					for _, l := range s.listeners {
-						l(s.state)
-					}
-				}
-				// persist state no matter if it has changed (time series)
-				if s.store != nil {
-					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-					s.state.mx.RLock()
-					err := s.store.Save(ctx, "gockpit", s.name, s.state.data, nil)
-					s.state.mx.RUnlock()
-					cancel()
-					if err != nil {
-						log.Error().Err(err).Msg("could not save metrics state")
-					}
-				}
-				s.mx.Unlock()
-			case <-ctx.Done():
-			}
+// jitter offsets the first sampling of the metric by a random fraction of its interval
+// so that metrics registered together do not keep sampling on the same tick
+func (s *Supervisor) jitter(m *Metric, now time.Time) {
+	if s.probeJitter <= 0 || m.interval <= 0 {
+		return
+	}
+	m.firstRun = now.Add(time.Duration(rand.Float64() * s.probeJitter * float64(m.interval)))
+}
+
+// RemoveProbe stops sampling the metric and clears its error.
+func (s *Supervisor) RemoveProbe(name string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.metrics, name)
+	s.state.clearError(name)
+	s.retick()
+}
+
+// tickInterval returns the tick of the sampling loop; the supervisor lock must be held
+func (s *Supervisor) tickInterval() time.Duration {
+	interval := s.samplingInterval
+	if s.adaptiveTick == 0 {
+		return interval
+	}
+	for _, m := range s.metrics {
+		if m.probe != nil && m.interval > 0 && m.interval < interval {
+			interval = m.interval
 		}
-	}()
+	}
+	if interval < s.adaptiveTick {
+		interval = s.adaptiveTick
+	}
+	return interval
 }
 
-func (s *Supervisor) Stop() {
-	if s.cancel == nil {
+// retick makes the sampling loop pick up the tick derived from changed metric intervals
+func (s *Supervisor) retick() {
+	if s.adaptiveTick == 0 {
 		return
 	}
-	s.cancel()
+	select {
+	case s.reconfigure <- struct{}{}:
+	default:
+	}
 }
 
-func (s *Supervisor) CollectError(code string, err error) error {
+// Schema describes all registered metrics indexed by name.
+func (s *Supervisor) Schema() map[string]MetricSchema {
 	s.mx.Lock()
 	defer s.mx.Unlock()
-	s.state.setError(code, err)
-	return err
+	schema := make(map[string]MetricSchema, len(s.metrics))
+	for name, m := range s.metrics {
+		ms := MetricSchema{Name: name, Interval: m.interval}
+		if m.valueRange != nil {
+			r := *m.valueRange
+			ms.Range = &r
+		}
+		schema[name] = ms
+	}
+	return schema
 }
 
-func (s *Supervisor) handlerState(w http.ResponseWriter, _ *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	enc := json.NewEncoder(w)
-	_ = enc.Encode(s.state)
+// MetricNames returns names of all registered metrics sorted alphabetically.
+func (s *Supervisor) MetricNames() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	names := make([]string, 0, len(s.metrics))
+	for name := range s.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Interval returns the sampling interval of the metric. Zero interval means every tick.
+func (s *Supervisor) Interval(name string) (time.Duration, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	m, found := s.metrics[name]
+	if !found {
+		return 0, false
+	}
+	return m.interval, true
+}
+
+// MetricInfo returns sampling information of all registered metrics sorted by name.
+func (s *Supervisor) MetricInfo() []MetricInfo {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	info := make([]MetricInfo, 0, len(s.metrics))
+	for name, m := range s.metrics {
+		info = append(info, MetricInfo{Name: name, Interval: m.interval, LastUpdate: m.lastUpdate, Status: m.status})
+	}
+	sort.Slice(info, func(i, j int) bool {
+		return info[i].Name < info[j].Name
+	})
+	return info
+}
+
+// ReplaceProbe swaps the probe of a registered metric keeping its sampling cadence.
+func (s *Supervisor) ReplaceProbe(name string, p interface{}) error {
+	if err := validateProbe(p); err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	m, found := s.metrics[name]
+	if !found {
+		return fmt.Errorf("%w: %s", ErrUnknownMetric, name)
+	}
+	m.probe = p
+	m.closed = false
+	s.retick()
+	return nil
+}
+
+func (s *Supervisor) AddAlert(ID string, a *Alert) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.state.mx.Lock()
+	defer s.state.mx.Unlock()
+	if s.state.alerts == nil {
+		s.state.alerts = make(Alerts)
+	}
+	a.id = ID
+	a.clock = s.clock
+	s.state.alerts[ID] = a
+	atomic.AddUint64(&s.state.version, 1)
+}
+
+// AddAlerts registers all alerts at once.
+func (s *Supervisor) AddAlerts(alerts map[string]*Alert) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.state.mx.Lock()
+	defer s.state.mx.Unlock()
+	if s.state.alerts == nil {
+		s.state.alerts = make(Alerts, len(alerts))
+	}
+	for id, a := range alerts {
+		a.id = id
+		a.clock = s.clock
+		s.state.alerts[id] = a
+	}
+	atomic.AddUint64(&s.state.version, 1)
+}
+
+// AlertActive tells if the alert is currently set.
+func (s *Supervisor) AlertActive(id string) bool {
+	s.state.mx.RLock()
+	defer s.state.mx.RUnlock()
+	a, found := s.state.alerts[id]
+	return found && a.IsSet
+}
+
+// AckAlert acknowledges an active alert suppressing its notifications until it clears.
+// It returns false if the alert is not registered or not set.
+func (s *Supervisor) AckAlert(id string) bool {
+	s.state.mx.Lock()
+	defer s.state.mx.Unlock()
+	a, found := s.state.alerts[id]
+	if !found || !a.IsSet {
+		return false
+	}
+	a.acked = true
+	atomic.AddUint64(&s.state.version, 1)
+	return true
+}
+
+// SilenceAlert suppresses notifications of the alert for d. The alert is still evaluated.
+// Non positive d lifts the silence. It returns false if the alert is not registered.
+func (s *Supervisor) SilenceAlert(id string, d time.Duration) bool {
+	s.state.mx.Lock()
+	defer s.state.mx.Unlock()
+	a, found := s.state.alerts[id]
+	if !found {
+		return false
+	}
+	a.silencedUntil = time.Time{}
+	if d > 0 {
+		a.silencedUntil = s.clock.Now().Add(d)
+	}
+	atomic.AddUint64(&s.state.version, 1)
+	return true
+}
+
+// ActiveAlerts returns sorted IDs of alerts that are currently set.
+func (s *Supervisor) ActiveAlerts() []string {
+	s.state.mx.RLock()
+	defer s.state.mx.RUnlock()
+	var active []string
+	for id, a := range s.state.alerts {
+		if a.IsSet {
+			active = append(active, id)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// Alerts returns descriptions of all registered alerts indexed by alert ID.
+func (s *Supervisor) Alerts() map[string]AlertInfo {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.state.mx.RLock()
+	defer s.state.mx.RUnlock()
+	alerts := make(map[string]AlertInfo, len(s.state.alerts))
+	now := s.clock.Now()
+	for id, a := range s.state.alerts {
+		alerts[id] = a.info(id, now)
+	}
+	return alerts
+}
+
+// Alert returns the description of the alert registered with the given ID.
+func (s *Supervisor) Alert(id string) (AlertInfo, bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.state.mx.RLock()
+	defer s.state.mx.RUnlock()
+	a, found := s.state.alerts[id]
+	if !found {
+		return AlertInfo{}, false
+	}
+	return a.info(id, s.clock.Now()), true
+}
+
+// AddDerived registers a metric computed from values of other metrics, e.g. a ratio of errors
+// to requests. fn is evaluated on every tick once all probes have applied their results and
+// the value it returns is set under name. fn may return nil if the value cannot be computed yet;
+// the metric then keeps its previous value. A panic of fn, e.g. of a getter reading a missing
+// dependency, is reported as the error of the metric.
+func (s *Supervisor) AddDerived(name string, fn func(*State) interface{}) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.derived == nil {
+		s.derived = make(map[string]func(*State) interface{})
+	}
+	s.derived[name] = fn
+}
+
+// derive evaluates derived metrics against the state updated by the probes and applies their values
+func (s *Supervisor) derive() *StateMutation {
+	s.mx.Lock()
+	names := make([]string, 0, len(s.derived))
+	derived := make(map[string]func(*State) interface{}, len(s.derived))
+	for name, fn := range s.derived {
+		names = append(names, name)
+		derived[name] = fn
+	}
+	s.mx.Unlock()
+	// derived metrics are evaluated in a stable order
+	sort.Strings(names)
+	mutation := s.state.With()
+	for _, name := range names {
+		val, err := s.evaluateDerived(derived[name])
+		mutation.SetError(name, err)
+		if err == nil && val != nil {
+			mutation.Set(name, val)
+		}
+	}
+	mutation.Apply()
+	return mutation
+}
+
+func (s *Supervisor) evaluateDerived(fn func(*State) interface{}) (val interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not derive value: %v", r)
+		}
+	}()
+	return fn(s.state), nil
+}
+
+// AccumulateDelta makes the supervisor add values reported by probes under deltaKey
+// to the total kept under totalKey. Deltas are consumed on every tick and never stored in the state.
+func (s *Supervisor) AccumulateDelta(deltaKey, totalKey string) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.deltas == nil {
+		s.deltas = make(map[string]string)
+	}
+	s.deltas[deltaKey] = totalKey
+}
+
+type listener struct {
+	id      uint64
+	notify  func(*State, listenerUpdate) error
+	changes Change
+	// errCode is the code under which errors of the listener are reported; empty if they are not
+	errCode string
+	// queue is set for listeners notified asynchronously
+	queue *listenerQueue
+}
+
+// listenerUpdate describes a state change listeners are notified about
+type listenerUpdate struct {
+	ctx  context.Context
+	keys []string
+	// events are the value transitions in the order they were applied
+	events []ChangeEvent
+}
+
+// coalesce adds the keys and events of a later update
+func (u listenerUpdate) coalesce(later listenerUpdate) listenerUpdate {
+	later.keys = mergeKeys(u.keys, later.keys)
+	later.events = append(u.events[:len(u.events):len(u.events)], later.events...)
+	return later
+}
+
+// listenerQueue buffers notifications of an asynchronous listener
+type listenerQueue struct {
+	mx      sync.Mutex
+	updates chan listenerUpdate
+	done    chan struct{}
+	dropped uint64
+}
+
+// push queues the update dropping the oldest queued ones if the buffer is full
+func (q *listenerQueue) push(update listenerUpdate) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	for {
+		select {
+		case q.updates <- update:
+			return
+		default:
+		}
+		select {
+		case oldest := <-q.updates:
+			atomic.AddUint64(&q.dropped, 1)
+			update = oldest.coalesce(update)
+		default:
+		}
+	}
+}
+
+func (q *listenerQueue) droppedCount() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// mergeKeys returns the sorted union of sorted key lists
+func mergeKeys(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			merged, a = append(merged, a[0]), a[1:]
+		case a[0] > b[0]:
+			merged, b = append(merged, b[0]), b[1:]
+		default:
+			merged, a, b = append(merged, a[0]), a[1:], b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// AddListener registers a listener notified on state changes. The returned function unregisters it;
+// it is safe to call it several times and from within the listener itself.
+func (s *Supervisor) AddListener(l Listener, changes ...Change) func() {
+	return s.AddCtxListener(func(_ context.Context, current *State) {
+		l(current)
+	}, changes...)
+}
+
+// AddCtxListener registers a context aware listener notified on state changes. Listeners may
+// limit notifications to the given kinds of changes and are notified on any change by default.
+// The returned function unregisters it.
+func (s *Supervisor) AddCtxListener(l CtxListener, changes ...Change) func() {
+	return s.addListener(func(current *State, update listenerUpdate) error {
+		l(update.ctx, current)
+		return nil
+	}, changes, false)
+}
+
+// AddErrListener registers a listener like AddListener whose failures are reported in the state
+// under the listener.<id> code so that they show in /state and /health. The error is resolved
+// by the next successful notification or once the listener is unregistered.
+func (s *Supervisor) AddErrListener(l ErrListener, changes ...Change) func() {
+	return s.addListener(func(current *State, _ listenerUpdate) error {
+		return l(current)
+	}, changes, true)
+}
+
+// AddKeysListener registers a listener notified on state changes together with the sorted keys
+// whose values have changed; keys are empty when only errors have changed. Notifications coalesced
+// by WithListenerDebounce carry the keys of all coalesced changes. The returned function unregisters it.
+func (s *Supervisor) AddKeysListener(l KeysListener, changes ...Change) func() {
+	return s.addListener(func(current *State, update listenerUpdate) error {
+		l(current, update.keys)
+		return nil
+	}, changes, false)
+}
+
+// AddChangeListener registers a listener receiving transitions of values, e.g. to build an audit
+// log of changes. It is called once per applied change with the events in the order they were
+// applied; notifications coalesced by WithListenerDebounce or dropped by asynchronous listeners
+// falling behind carry all their events. The returned function unregisters it.
+func (s *Supervisor) AddChangeListener(l ChangeListener) func() {
+	return s.addListener(func(current *State, update listenerUpdate) error {
+		if len(update.events) > 0 {
+			l(current, update.events)
+		}
+		return nil
+	}, []Change{DataChange}, false)
+}
+
+func (s *Supervisor) addListener(l func(*State, listenerUpdate) error, changes []Change, reportErrors bool) func() {
+	var filter Change
+	for _, c := range changes {
+		filter |= c
+	}
+	if filter == 0 {
+		filter = AnyChange
+	}
+	s.listenersMx.Lock()
+	defer s.listenersMx.Unlock()
+	s.nextListenerID++
+	id := s.nextListenerID
+	registered := listener{id: id, notify: l, changes: filter}
+	if reportErrors {
+		registered.errCode = fmt.Sprintf("listener.%d", id)
+	}
+	if s.listenerBuffer > 0 {
+		registered.queue = &listenerQueue{updates: make(chan listenerUpdate, s.listenerBuffer), done: make(chan struct{})}
+		go s.serve(registered)
+	}
+	s.listeners = append(s.listeners, registered)
+	return func() {
+		s.removeListener(id)
+	}
+}
+
+func (s *Supervisor) removeListener(id uint64) {
+	s.listenersMx.Lock()
+	defer s.listenersMx.Unlock()
+	// listeners are copied on removal so that ongoing notifications iterate over an intact slice
+	listeners := make([]listener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		if l.id != id {
+			listeners = append(listeners, l)
+			continue
+		}
+		if l.errCode != "" {
+			s.state.clearError(l.errCode)
+		}
+		if l.queue != nil {
+			close(l.queue.done)
+		}
+	}
+	s.listeners = listeners
+}
+
+// serve notifies an asynchronous listener until it is unregistered
+func (s *Supervisor) serve(l listener) {
+	for {
+		select {
+		case update := <-l.queue.updates:
+			s.call(l, update)
+		case <-l.queue.done:
+			return
+		}
+	}
+}
+
+// notify tells listeners about the changes applied with mutation
+func (s *Supervisor) notify(ctx context.Context, mutation *StateMutation) {
+	changes := mutation.changes
+	update := listenerUpdate{ctx: ctx, keys: mutation.ChangedKeys(), events: mutation.Events()}
+	if s.debounce != nil && !s.debounce.allow(changes, update, s.clock.Now(), s.dispatch) {
+		return
+	}
+	s.dispatch(changes, update)
+}
+
+func (s *Supervisor) dispatch(changes Change, update listenerUpdate) {
+	s.listenersMx.Lock()
+	listeners := s.listeners
+	s.listenersMx.Unlock()
+	for _, l := range listeners {
+		if l.changes&changes == 0 {
+			continue
+		}
+		if l.queue != nil {
+			l.queue.push(update)
+			continue
+		}
+		s.call(l, update)
+	}
+}
+
+// call invokes the listener making sure its panic does not stop sampling
+func (s *Supervisor) call(l listener, update listenerUpdate) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error().Interface("panic", r).Uint64("listener", l.id).Msg("listener panicked")
+			if l.errCode != "" {
+				s.state.setError(l.errCode, SeverityError, fmt.Errorf("listener panicked: %v", r))
+			}
+		}
+	}()
+	err := l.notify(s.state, update)
+	if l.errCode == "" {
+		return
+	}
+	if err != nil {
+		s.state.setError(l.errCode, SeverityError, err)
+		return
+	}
+	s.state.clearError(l.errCode)
+}
+
+type debouncer struct {
+	mx sync.Mutex
+	// clock schedules trailing notifications; it is the one of the supervisor
+	clock    Clock
+	interval time.Duration
+	last     time.Time
+	pending  bool
+	// trailing is the timer of the pending notification
+	trailing Timer
+	// changes, keys and events coalesced into the trailing notification
+	changes Change
+	update  listenerUpdate
+}
+
+// allow tells if listeners may be notified right away. Otherwise a trailing notification
+// is scheduled at the end of the current interval.
+func (d *debouncer) allow(changes Change, update listenerUpdate, now time.Time, dispatch func(Change, listenerUpdate)) bool {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.pending {
+		d.changes |= changes
+		d.update = d.update.coalesce(update)
+		return false
+	}
+	if now.Sub(d.last) >= d.interval {
+		d.last = now
+		return true
+	}
+	d.changes = changes
+	d.update = update
+	d.pending = true
+	d.trailing = d.clock.AfterFunc(d.last.Add(d.interval).Sub(now), func() {
+		d.mx.Lock()
+		if !d.pending {
+			// dropped by stop
+			d.mx.Unlock()
+			return
+		}
+		changes, update := d.changes, d.update
+		d.reset()
+		d.last = d.clock.Now()
+		d.mx.Unlock()
+		dispatch(changes, update)
+	})
+	return false
+}
+
+// stop drops the pending trailing notification
+func (d *debouncer) stop() {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.pending {
+		d.trailing.Stop()
+		d.reset()
+	}
+}
+
+func (d *debouncer) reset() {
+	d.pending = false
+	d.trailing = nil
+	d.changes = 0
+	d.update = listenerUpdate{}
+}
+
+func (s *Supervisor) Run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.runMx.Lock()
+	s.ctx, s.cancel, s.done = ctx, cancel, done
+	s.runMx.Unlock()
+	saves := make(chan savedState, storeQueueSize)
+	saved := make(chan struct{})
+	s.mx.Lock()
+	interval := s.tickInterval()
+	if s.store != nil {
+		s.saves = saves
+	}
+	s.stats.StartTime = s.clock.Now()
+	s.state.setMeta(s.stats.meta())
+	s.mx.Unlock()
+	go func() {
+		defer close(saved)
+		for st := range saves {
+			s.save(st)
+		}
+	}()
+	go func() {
+		defer close(done)
+		ticker := s.clock.NewTicker(interval)
+		defer func() {
+			ticker.Stop()
+			// let the store finish pending saves
+			s.mx.Lock()
+			s.saves = nil
+			s.mx.Unlock()
+			close(saves)
+			<-saved
+		}()
+		for {
+			select {
+			case now := <-ticker.C():
+				s.tick(ctx, now)
+			case <-s.reconfigure:
+				s.mx.Lock()
+				next := s.tickInterval()
+				s.mx.Unlock()
+				if next == interval {
+					continue
+				}
+				interval = next
+				ticker.Stop()
+				ticker = s.clock.NewTicker(interval)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// SetSamplingInterval changes the sampling interval of a running or not yet started supervisor.
+// Non positive interval restores the default one.
+func (s *Supervisor) SetSamplingInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSamplingInterval
+	}
+	if interval < minSamplingInterval {
+		interval = minSamplingInterval
+	}
+	s.mx.Lock()
+	s.samplingInterval = interval
+	s.mx.Unlock()
+	select {
+	case s.reconfigure <- struct{}{}:
+	default:
+		// the loop has not picked up the previous change yet and will read the latest interval
+	}
+}
+
+// runContext returns the context of the sampling loop or the background context if it is not running
+func (s *Supervisor) runContext() context.Context {
+	s.runMx.Lock()
+	defer s.runMx.Unlock()
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// SampleNow runs all probes right away no matter their intervals. It waits for
+// a sampling pass of the loop that is in progress. Listeners are notified and the state
+// is persisted like after a regular tick. The returned snapshot holds the results of the pass.
+func (s *Supervisor) SampleNow(ctx context.Context) *State {
+	s.sampling.Lock()
+	defer s.sampling.Unlock()
+	s.sample(ctx, s.clock.Now(), true)
+	return s.state.SnapshotState()
+}
+
+func (s *Supervisor) tick(ctx context.Context, now time.Time) {
+	s.sampling.Lock()
+	defer s.sampling.Unlock()
+	s.sample(ctx, now, false)
+}
+
+// sample runs due (or all if forced) probes concurrently; if names are given only the named probes are
+// considered. The supervisor lock guards the metrics registry while probes run without holding it;
+// only merging and applying their results is serialized.
+func (s *Supervisor) sample(ctx context.Context, now time.Time, force bool, names ...string) {
+	// locks are released by deferred calls so that a panic does not stop sampling for good
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error().Interface("panic", r).Str("phase", s.phase).Bytes("stack", debug.Stack()).Msg("sampling pass panicked")
+			s.state.setError(TickErrorCode, SeverityCritical, fmt.Errorf("sampling pass panicked in %s phase: %v", s.phase, r))
+		}
+	}()
+	start := time.Now()
+	s.phase = "probe"
+	s.mx.Lock()
+	var due []Metric
+	var skipped []string
+	slack := s.tickInterval() / 2
+	for _, mg := range s.metrics {
+		if mg.probe == nil || !selected(mg.name, names) {
+			continue
+		}
+		if s.stalled[mg.name] || mg.closed {
+			skipped = append(skipped, mg.name)
+			continue
+		}
+		if force || mg.due(now, slack) {
+			// probes run on a copy so that registry changes do not race with sampling
+			due = append(due, *mg)
+			mg.lastUpdate = now
+		} else {
+			skipped = append(skipped, mg.name)
+		}
+	}
+	s.mx.Unlock()
+
+	// probes are run level by level so that the ones registered with AddProbeAfter
+	// read values of their dependencies sampled within the same tick
+	var deadline time.Time
+	if s.tickBudget > 0 {
+		deadline = start.Add(s.tickBudget)
+	}
+	mutation := s.state.With()
+	levels := dependencyLevels(due)
+	for i, level := range levels {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			s.skipLevels(levels[i:], now)
+			break
+		}
+		mutation.merge(s.sampleLevel(ctx, level, deadline))
+	}
+	s.phase = "derive"
+	mutation.merge(s.derive())
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.phase = "listener"
+	if mutation.dirty() {
+		s.notify(ctx, mutation)
+	}
+	s.phase = "persist"
+	s.persist(now, mutation)
+	s.stats.record(now, time.Since(start), s.tickInterval(), len(due), len(skipped))
+	if !s.stats.StartTime.IsZero() {
+		s.state.setMeta(s.stats.meta())
+	}
+	s.state.clearError(TickErrorCode)
+}
+
+// selected tells if the metric is among names; all metrics are selected if names are empty
+func selected(name string, names []string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleLevel runs probes concurrently and applies their results. Probes still running
+// at a non zero deadline are abandoned.
+func (s *Supervisor) sampleLevel(ctx context.Context, level []*Metric, deadline time.Time) *StateMutation {
+	mutations := make([]*StateMutation, len(level))
+	finished := make([]chan struct{}, len(level))
+	for i, mg := range level {
+		mutations[i] = s.state.With()
+		finished[i] = make(chan struct{})
+		go func(mg *Metric, mutation *StateMutation, finished chan struct{}) {
+			defer func() {
+				// done under the lock so that the probe is either collected or marked as stalled
+				s.mx.Lock()
+				close(finished)
+				delete(s.stalled, mg.name)
+				s.mx.Unlock()
+			}()
+			mg.updateState(ctx, mutation)
+		}(mg, mutations[i], finished[i])
+	}
+	waitFinished(finished, deadline)
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.phase = "merge"
+	mutation := s.state.With()
+	var stalled []string
+	for i, m := range mutations {
+		name := level[i].name
+		select {
+		case <-finished[i]:
+		default:
+			// the probe keeps writing to its own mutation which is dropped once it returns
+			s.stalled[name] = true
+			stalled = append(stalled, name)
+			m = s.state.With().SetError(name, fmt.Errorf("probe %s exceeded the tick budget of %s", name, s.tickBudget))
+		}
+		if registered, found := s.metrics[name]; found {
+			registered.status = statusOf(name, m)
+		}
+		mutation.merge(m)
+	}
+	if len(stalled) > 0 {
+		s.logger.Warn().Strs("probes", stalled).Dur("budget", s.tickBudget).Msg("tick budget exceeded")
+	}
+	for deltaKey, totalKey := range s.deltas {
+		delta, found := mutation.take(deltaKey)
+		if !found {
+			continue
+		}
+		total, ok := addNumeric(s.state.Elem(totalKey), delta)
+		if !ok {
+			mutation.SetError(deltaKey, fmt.Errorf("could not add delta %v to total %s", delta, totalKey))
+			continue
+		}
+		mutation.Set(totalKey, total)
+	}
+	// applying the mutation evaluates alerts
+	s.phase = "alert"
+	mutation.Apply()
+	s.phase = "probe"
+	return mutation
+}
+
+// skipLevels marks probes left out of a pass that ran out of its tick budget as skipped and makes
+// them due again so that they are sampled in the next pass.
+func (s *Supervisor) skipLevels(levels [][]*Metric, now time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	var skipped []string
+	for _, level := range levels {
+		for _, mg := range level {
+			skipped = append(skipped, mg.name)
+			registered, found := s.metrics[mg.name]
+			if !found {
+				continue
+			}
+			registered.status = MetricSkipped
+			if registered.lastUpdate.Equal(now) {
+				// the copy holds the time of the previous run
+				registered.lastUpdate = mg.lastUpdate
+			}
+		}
+	}
+	s.logger.Warn().Strs("probes", skipped).Dur("budget", s.tickBudget).Msg("probes skipped, tick budget exceeded")
+}
+
+// waitFinished waits until all channels are closed or the deadline passes. Zero deadline means no limit.
+func waitFinished(finished []chan struct{}, deadline time.Time) {
+	if deadline.IsZero() {
+		for _, ch := range finished {
+			<-ch
+		}
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for _, ch := range finished {
+		select {
+		case <-ch:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// dependencyLevels groups due metrics so that every metric is placed in a level
+// following the levels of its due dependencies. Metrics without dependencies form the first level.
+func dependencyLevels(due []Metric) [][]*Metric {
+	index := make(map[string]int, len(due))
+	for i := range due {
+		index[due[i].name] = i
+	}
+	depth := make(map[int]int, len(due))
+	var levelOf func(i int) int
+	levelOf = func(i int) int {
+		if d, found := depth[i]; found {
+			return d
+		}
+		d := 0
+		for _, dep := range due[i].after {
+			// cycles are rejected on registration
+			if j, found := index[dep]; found && levelOf(j)+1 > d {
+				d = levelOf(j) + 1
+			}
+		}
+		depth[i] = d
+		return d
+	}
+	var levels [][]*Metric
+	for i := range due {
+		d := levelOf(i)
+		for len(levels) <= d {
+			levels = append(levels, nil)
+		}
+		levels[d] = append(levels[d], &due[i])
+	}
+	return levels
+}
+
+// persist saves current state in the store. Unless significant keys are configured
+// state is persisted no matter if it has changed (time series). While the sampling loop
+// is running snapshots are saved asynchronously so that the store does not block sampling.
+// With a persist interval the state is saved once per interval; see WithPersistInterval.
+func (s *Supervisor) persist(now time.Time, mutation *StateMutation) {
+	if s.store == nil {
+		return
+	}
+	for key := range s.significantKeys {
+		if mutation.changed(key) {
+			s.significantChanged = true
+		}
+	}
+	if len(s.aggregations) > 0 {
+		if s.window == nil {
+			s.window = make(persistWindow)
+		}
+		s.state.mx.RLock()
+		s.window.add(s.state.data)
+		s.state.mx.RUnlock()
+	}
+	if s.persistInterval > 0 && now.Before(s.lastSave.Add(s.persistInterval)) {
+		return
+	}
+	if !s.shouldPersist(now) {
+		return
+	}
+	s.state.mx.RLock()
+	st := savedState{time: now, fields: s.persistedFields()}
+	for key, ts := range s.state.timestamps {
+		if st.timestamps == nil {
+			st.timestamps = make(map[string]time.Time, len(s.state.timestamps))
+		}
+		st.timestamps[s.nameTransformer(key)] = ts
+	}
+	s.state.mx.RUnlock()
+	s.window.fields(st.fields, s.aggregations)
+	st.fields = s.exportFields(st.fields)
+	s.window = nil
+	s.significantChanged = false
+	s.lastSave = now
+	if s.saves == nil {
+		s.save(st)
+		return
+	}
+	select {
+	case s.saves <- st:
+	default:
+		// the store cannot keep up; drop the oldest snapshot
+		select {
+		case <-s.saves:
+			s.stats.DroppedSaves++
+		default:
+		}
+		s.saves <- st
+	}
+}
+
+type savedState struct {
+	time   time.Time
+	fields map[string]interface{}
+	// timestamps of fields set with SetAt
+	timestamps map[string]time.Time
+}
+
+// points splits fields into points by their timestamps ordered by time
+func (st savedState) points() []Point {
+	// the point of the tick is saved even if all values have their own timestamps
+	byTime := map[time.Time]map[string]interface{}{st.time: {}}
+	for key, val := range st.fields {
+		ts, found := st.timestamps[key]
+		if !found {
+			ts = st.time
+		}
+		if byTime[ts] == nil {
+			byTime[ts] = make(map[string]interface{})
+		}
+		byTime[ts][key] = val
+	}
+	points := make([]Point, 0, len(byTime))
+	for ts, fields := range byTime {
+		points = append(points, Point{Time: ts, Fields: fields})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points
+}
+
+func (s *Supervisor) save(st savedState) {
+	s.backoffMx.Lock()
+	retryAt := s.storeRetryAt
+	s.backoffMx.Unlock()
+	if st.time.Before(retryAt) {
+		// the store keeps failing; do not wait for it until backoff elapses
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.storeTimeout)
+	var err error
+	if writer, ok := s.store.(PointWriter); ok {
+		err = writer.SavePoints(ctx, storeBucket, s.name, st.points(), s.tags)
+	} else {
+		err = s.store.Save(ctx, storeBucket, s.name, st.fields, s.tags)
+	}
+	cancel()
+	s.backoffMx.Lock()
+	defer s.backoffMx.Unlock()
+	if err != nil {
+		backoff := storeBackoffMin << s.storeFailures
+		if backoff > storeBackoffMax || backoff <= 0 {
+			backoff = storeBackoffMax
+		}
+		s.storeFailures++
+		s.storeRetryAt = st.time.Add(backoff)
+		s.state.setError(StoreErrorCode, SeverityError, fmt.Errorf("could not save state: %w", err))
+		s.logger.Error().Err(err).Dur("backoff", backoff).Msg("could not save metrics state")
+		return
+	}
+	if s.storeFailures > 0 {
+		s.storeFailures = 0
+		s.storeRetryAt = time.Time{}
+		s.state.clearError(StoreErrorCode)
+	}
+}
+
+// persistedFields returns fields saved in the store; state lock must be held
+func (s *Supervisor) persistedFields() map[string]interface{} {
+	// the snapshot is saved asynchronously so it must not share memory with the state
+	fields := s.state.snapshotData()
+	for key, val := range fields {
+		// stores get histograms flattened into scalar fields
+		if h, ok := val.(Histogram); ok {
+			delete(fields, key)
+			for name, v := range h.fields(key) {
+				fields[name] = v
+			}
+		}
+	}
+	if !s.persistErrors {
+		return fields
+	}
+	for code, e := range s.state.errors {
+		fields["error."+code] = e.Count
+	}
+	for id, a := range s.state.alerts {
+		fields["alert."+id] = a.IsSet
+	}
+	return fields
+}
+
+// exportFields renames fields with the name transformer
+func (s *Supervisor) exportFields(fields map[string]interface{}) map[string]interface{} {
+	exported := make(map[string]interface{}, len(fields))
+	for key, val := range fields {
+		exported[s.nameTransformer(key)] = val
+	}
+	return exported
+}
+
+func (s *Supervisor) shouldPersist(now time.Time) bool {
+	if len(s.significantKeys) == 0 {
+		return true
+	}
+	if s.maxStaleness > 0 && !now.Before(s.lastSave.Add(s.maxStaleness)) {
+		return true
+	}
+	return s.significantChanged
+}
+
+// Stop stops the sampling loop and waits until it exits, including the tick in progress, or until
+// ctx expires. Probes implementing io.Closer are closed then unless ctx expires first while SampleNow
+// is running them; see WithProbeCloseTimeout. Closed probes are skipped by passes forced later on
+// unless replaced with ReplaceProbe. Finally, if a store is configured, a marker of the clean
+// shutdown is persisted for LastShutdownClean.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.runMx.Lock()
+	cancel, done := s.cancel, s.done
+	s.runMx.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return fmt.Errorf("sampling loop did not stop: %w", ctx.Err())
+		}
+	}
+	if s.debounce != nil {
+		// listeners would be called with the context cancelled above
+		s.debounce.stop()
+	}
+	if err := s.closeProbes(ctx); err != nil {
+		return err
+	}
+	if s.store == nil {
+		return nil
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	ctx, cancelSave := context.WithTimeout(ctx, s.storeTimeout)
+	defer cancelSave()
+	err := s.store.Save(ctx, storeBucket, s.name+shutdownSuffix, map[string]interface{}{"clean": true}, s.tags)
+	if err != nil {
+		return fmt.Errorf("could not save clean shutdown marker: %w", err)
+	}
+	return nil
+}
+
+// closeProbes closes probes implementing io.Closer in parallel so that they release their resources,
+// e.g. database connections. Probes are closed once; closers still running after the timeout
+// are abandoned. Errors are logged. It returns an error without closing anything if ctx expires
+// while a forced sampling pass is running.
+func (s *Supervisor) closeProbes(ctx context.Context) error {
+	// a forced sampling pass must not run probes being closed
+	locked := make(chan struct{})
+	go func() {
+		s.sampling.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		go func() {
+			// release the lock once the pass in progress lets go of it
+			<-locked
+			s.sampling.Unlock()
+		}()
+		return fmt.Errorf("probes not closed, sampling pass in progress: %w", ctx.Err())
+	}
+	defer s.sampling.Unlock()
+	s.mx.Lock()
+	if s.probesClosed {
+		s.mx.Unlock()
+		return nil
+	}
+	s.probesClosed = true
+	closers := make(map[string]io.Closer)
+	for name, m := range s.metrics {
+		if c, ok := m.probe.(io.Closer); ok {
+			closers[name] = c
+			m.closed = true
+		}
+	}
+	timeout := s.closeTimeout
+	s.mx.Unlock()
+	if len(closers) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for name, c := range closers {
+		wg.Add(1)
+		go func(name string, c io.Closer) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					s.logger.Error().Interface("panic", r).Str("probe", name).Msg("probe panicked on close")
+				}
+			}()
+			if err := c.Close(); err != nil {
+				s.logger.Error().Err(err).Str("probe", name).Msg("could not close probe")
+			}
+		}(name, c)
+	}
+	closed := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		s.logger.Warn().Dur("timeout", timeout).Msg("probes did not close in time")
+	}
+	return nil
+}
+
+// Restore reads information about the previous run from the store and loads the last persisted
+// state. Each key gets the value of the latest point holding it since values set with SetAt are
+// saved in points of their own. Values are restored with the types returned by the store except
+// for numbers which are coerced the way they are usually set by probes: json.Number and int64
+// values become int when they hold an integer and float64 otherwise. Floats stay float64 even if
+// they hold a whole number.
+func (s *Supervisor) Restore(ctx context.Context) error {
+	reader, ok := s.store.(Reader)
+	if !ok {
+		return ErrNoReader
+	}
+	if s.nameInverse == nil {
+		// stored names would be loaded next to the canonical ones
+		return ErrNoNameInverse
+	}
+	markers, err := reader.Query(ctx, storeBucket, s.name+shutdownSuffix, 0)
+	if err != nil {
+		return fmt.Errorf("could not query shutdown markers: %w", err)
+	}
+	states, err := reader.Query(ctx, storeBucket, s.name, 0)
+	if err != nil {
+		return fmt.Errorf("could not query persisted state: %w", err)
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if len(states) > 0 {
+		// points are ordered by time so later values override earlier ones
+		fields := make(map[string]interface{})
+		for _, p := range states {
+			for key, val := range p.Fields {
+				fields[key] = val
+			}
+		}
+		mutation := s.state.With()
+		for key, val := range fields {
+			key = s.nameInverse(key)
+			if s.persistErrors && (strings.HasPrefix(key, "error.") || strings.HasPrefix(key, "alert.")) {
+				continue
+			}
+			mutation.Set(key, restoredValue(val))
+		}
+		mutation.Apply()
+	}
+	s.cleanShutdown = false
+	s.lastShutdown = time.Time{}
+	if len(markers) == 0 {
+		return nil
+	}
+	s.lastShutdown = markers[len(markers)-1].Time
+	// state saved after the last marker means the following run did not stop cleanly
+	s.cleanShutdown = len(states) == 0 || !states[len(states)-1].Time.After(s.lastShutdown)
+	return nil
+}
+
+// restoredValue converts decoded numbers to int when integral and float64 otherwise
+func restoredValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = restoredValue(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = restoredValue(elem)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil && int64(int(i)) == i {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case int64:
+		if int64(int(v)) == v {
+			return int(v)
+		}
+	}
+	return val
+}
+
+// LastShutdownClean tells if the previous run was stopped cleanly and when, as found by Restore.
+func (s *Supervisor) LastShutdownClean() (bool, time.Time) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.cleanShutdown, s.lastShutdown
+}
+
+// Stats returns sampling statistics gathered since the supervisor was started.
+func (s *Supervisor) Stats() SamplerStats {
+	s.mx.Lock()
+	stats := s.stats
+	s.mx.Unlock()
+	if s.pushLimit != nil {
+		stats.DroppedPushes = s.pushLimit.droppedCount()
+	}
+	if !stats.StartTime.IsZero() {
+		stats.Uptime = s.clock.Now().Sub(stats.StartTime)
+	}
+	stats.EvictedErrors = s.state.EvictedErrors()
+	s.listenersMx.Lock()
+	for _, l := range s.listeners {
+		if l.queue == nil {
+			continue
+		}
+		if stats.DroppedUpdates == nil {
+			stats.DroppedUpdates = make(map[string]uint64)
+		}
+		stats.DroppedUpdates[fmt.Sprintf("listener.%d", l.id)] = l.queue.droppedCount()
+	}
+	s.listenersMx.Unlock()
+	return stats
+}
+
+// CollectError records err under code in the state and returns it. It only locks the state
+// so it does not wait for sampling or persistence in progress. Error codes share the namespace
+// with metric names; an error collected under a metric name takes precedence over the errors
+// of its probe, which neither overwrite nor clear it until it is cleared with a nil err.
+func (s *Supervisor) CollectError(code string, err error) error {
+	return s.CollectErrorLevel(code, SeverityError, err)
+}
+
+// CollectErrorLevel records err of the given severity under code; see CollectError.
+func (s *Supervisor) CollectErrorLevel(code string, severity Severity, err error) error {
+	s.state.setError(code, severity, err)
+	return err
+}
+
+// projectedKeys parses the comma separated keys the state is limited to; nil means the whole state
+func projectedKeys(param string) map[string]bool {
+	var keys map[string]bool
+	for _, key := range strings.Split(param, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		if keys == nil {
+			keys = make(map[string]bool)
+		}
+		keys[key] = true
+	}
+	return keys
+}
+
+// handlerState renders the state. The keys query parameter, e.g. ?keys=qps,latency, limits it
+// to the given values together with their errors and alerts. Responses are tagged with the state
+// version, so the meta section only holds the version; the uptime and tick counts change without
+// bumping it and are served with the state stream and /stats.
+func (s *Supervisor) handlerState(w http.ResponseWriter, r *http.Request) {
+	contentType, encode, err := negotiate(r.Header.Get("Accept"))
+	if err != nil {
+		_ = writeJSONResponse(w, http.StatusNotAcceptable, struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	w.Header().Set("ETag", stateETag(s.state.Version(), contentType))
+	w.Header().Add("Vary", "Accept, Accept-Encoding")
+	if etagMatches(r.Header.Get("If-None-Match"), w.Header().Get("ETag")) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	current := s.state.project(projectedKeys(r.URL.Query().Get("keys")))
+	current.meta = nil
+	// the snapshot may be newer than the version checked above
+	w.Header().Set("ETag", stateETag(current.Version(), contentType))
+	body, err := encode(current)
+	if err != nil {
+		_ = writeJSONResponse(w, http.StatusInternalServerError, struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if len(body) >= gzipMinSize && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		if compressed, err := gzipBytes(body); err == nil {
+			w.Header().Set("Content-Encoding", "gzip")
+			body = compressed
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+func stateETag(version uint64, contentType string) string {
+	return fmt.Sprintf(`W/"%d-%s"`, version, contentType[strings.Index(contentType, "/")+1:])
+}
+
+func (s *Supervisor) handlerStateCSV(w http.ResponseWriter, r *http.Request) {
+	current := s.state
+	if keys := projectedKeys(r.URL.Query().Get("keys")); keys != nil {
+		current = s.state.project(keys)
+	}
+	body, err := current.MarshalCSV()
+	if err != nil {
+		_ = writeJSONResponse(w, http.StatusInternalServerError, struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", CSVContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+func (s *Supervisor) handlerStats(w http.ResponseWriter, _ *http.Request) {
+	_ = writeJSONResponse(w, http.StatusOK, s.Stats())
+}
+
+func (s *Supervisor) handlerSchema(w http.ResponseWriter, _ *http.Request) {
+	_ = writeJSONResponse(w, http.StatusOK, s.Schema())
+}
+
+type health struct {
+	Status string   `json:"status"`
+	Errors []string `json:"errors,omitempty"`
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+func (h health) healthy() bool {
+	return h.Status == "ok"
+}
+
+// handlerHealth reports the supervisor unhealthy if there are errors or active alerts.
+// The severity query parameter limits errors to the ones of at least the given severity.
+func (s *Supervisor) handlerHealth(w http.ResponseWriter, r *http.Request) {
+	min, err := minSeverity(r)
+	if err != nil {
+		_ = writeJSONResponse(w, http.StatusBadRequest, struct {
+			Error string `json:"error"`
+		}{err.Error()})
+		return
+	}
+	h := s.health(min)
+	if h.healthy() {
+		_ = writeJSONResponse(w, http.StatusOK, h)
+		return
+	}
+	_ = writeJSONResponse(w, http.StatusServiceUnavailable, h)
+}
+
+// minSeverity reads the severity query parameter; all errors are considered by default
+func minSeverity(r *http.Request) (Severity, error) {
+	param := r.URL.Query().Get("severity")
+	if param == "" {
+		return SeverityInfo, nil
+	}
+	return ParseSeverity(param)
+}
+
+// health reports errors of at least min severity and active alerts
+func (s *Supervisor) health(min Severity) health {
+	h := health{Status: "ok"}
+	s.state.mx.RLock()
+	for code, e := range s.state.errors {
+		if e.Severity < min {
+			continue
+		}
+		if s.healthCodes == nil || s.healthCodes[code] {
+			h.Errors = append(h.Errors, code)
+		}
+	}
+	for id, a := range s.state.alerts {
+		if a.IsSet {
+			h.Alerts = append(h.Alerts, id)
+		}
+	}
+	s.state.mx.RUnlock()
+	if len(h.Errors) == 0 && len(h.Alerts) == 0 {
+		return h
+	}
+	sort.Strings(h.Errors)
+	sort.Strings(h.Alerts)
+	h.Status = "unhealthy"
+	return h
+}
+
+// HistoryPoint is a single sample of a metric returned by the /history endpoint.
+type HistoryPoint struct {
+	Time  time.Time   `json:"time"`
+	Value interface{} `json:"value"`
+}
+
+// History returns values of metric persisted within the since period (zero means no limit) ordered by time.
+// Points in which the metric is missing are skipped.
+func (s *Supervisor) History(ctx context.Context, metric string, since time.Duration) ([]HistoryPoint, error) {
+	reader, ok := s.store.(Reader)
+	if !ok {
+		return nil, ErrNoReader
+	}
+	points, err := reader.Query(ctx, storeBucket, s.name, since)
+	if err != nil {
+		return nil, fmt.Errorf("could not query history of %s: %w", metric, err)
+	}
+	history := make([]HistoryPoint, 0, len(points))
+	name := s.nameTransformer(metric)
+	for _, p := range points {
+		if val, found := p.Fields[name]; found {
+			history = append(history, HistoryPoint{Time: p.Time, Value: val})
+		}
+	}
+	return history, nil
+}
+
+func (s *Supervisor) handlerHistory(w http.ResponseWriter, r *http.Request) {
+	type errorResponse struct {
+		Error string `json:"error"`
+	}
+	query := r.URL.Query()
+	metric := query.Get("metric")
+	if metric == "" {
+		_ = writeJSONResponse(w, http.StatusBadRequest, errorResponse{"metric is required"})
+		return
+	}
+	var since time.Duration
+	if param := query.Get("since"); param != "" {
+		var err error
+		if since, err = time.ParseDuration(param); err != nil {
+			_ = writeJSONResponse(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid since: %s", err)})
+			return
+		}
+	}
+	var limit int
+	if param := query.Get("limit"); param != "" {
+		var err error
+		if limit, err = strconv.Atoi(param); err != nil || limit < 0 {
+			_ = writeJSONResponse(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid limit: %s", param)})
+			return
+		}
+	}
+	history, err := s.History(r.Context(), metric, since)
+	if errors.Is(err, ErrNoReader) {
+		_ = writeJSONResponse(w, http.StatusNotImplemented, errorResponse{err.Error()})
+		return
+	}
+	if err != nil {
+		_ = writeJSONResponse(w, http.StatusInternalServerError, errorResponse{err.Error()})
+		return
+	}
+	if limit > 0 && len(history) > limit {
+		// keep the latest points
+		history = history[len(history)-limit:]
+	}
+	_ = writeJSONResponse(w, http.StatusOK, history)
+}
+
+func (s *Supervisor) handlerAckAlert(w http.ResponseWriter, r *http.Request) {
+	type errorResponse struct {
+		Error string `json:"error"`
+	}
+	id := chi.URLParam(r, "id")
+	if _, found := s.Alert(id); !found {
+		_ = writeJSONResponse(w, http.StatusNotFound, errorResponse{fmt.Sprintf("unknown alert %s", id)})
+		return
+	}
+	if !s.AckAlert(id) {
+		_ = writeJSONResponse(w, http.StatusConflict, errorResponse{fmt.Sprintf("alert %s is not active", id)})
+		return
+	}
+	info, _ := s.Alert(id)
+	_ = writeJSONResponse(w, http.StatusOK, info)
+}
+
+func (s *Supervisor) handlerSilenceAlert(w http.ResponseWriter, r *http.Request) {
+	type errorResponse struct {
+		Error string `json:"error"`
+	}
+	id := chi.URLParam(r, "id")
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil {
+		_ = writeJSONResponse(w, http.StatusBadRequest, errorResponse{fmt.Sprintf("invalid duration: %s", err)})
+		return
+	}
+	if !s.SilenceAlert(id, d) {
+		_ = writeJSONResponse(w, http.StatusNotFound, errorResponse{fmt.Sprintf("unknown alert %s", id)})
+		return
+	}
+	info, _ := s.Alert(id)
+	_ = writeJSONResponse(w, http.StatusOK, info)
+}
+
+func (s *Supervisor) handlerProbes(w http.ResponseWriter, _ *http.Request) {
+	_ = writeJSONResponse(w, http.StatusOK, s.MetricInfo())
 }
 
 func (s *Supervisor) String(id string) string {
@@ -214,6 +2373,18 @@ func (s *Supervisor) String(id string) string {
 
 func (s *Supervisor) HTTPHandler() http.Handler {
 	r := chi.NewRouter()
+	r.Use(s.middlewares...)
 	r.Get("/state", s.handlerState)
+	r.Get("/state/stream", s.handlerStateStream)
+	r.Get("/state/ws", s.handlerStateSocket)
+	r.Get("/state.csv", s.handlerStateCSV)
+	r.Get("/stats", s.handlerStats)
+	r.Get("/schema", s.handlerSchema)
+	r.Get("/probes", s.handlerProbes)
+	r.Get("/health", s.handlerHealth)
+	r.Get("/history", s.handlerHistory)
+	r.Get("/metrics", s.handlerPrometheus)
+	r.Post("/alerts/{id}/ack", s.handlerAckAlert)
+	r.Post("/alerts/{id}/silence", s.handlerSilenceAlert)
 	return r
 }
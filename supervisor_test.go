@@ -1,37 +1,1862 @@
 package gockpit
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack"
+	"gopkg.in/yaml.v2"
 )
 
 func TestSupervisor_Run(t *testing.T) {
-	sup := NewSupervisor("test", WithSamplingInterval(20*time.Millisecond))
-	var expectedCurrent State
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock))
+	notified := make(chan *State, 1)
 	sup.AddListener(func(current *State) {
-		assert.Equal(t, expectedCurrent, current, "current state mismatch")
+		notified <- current
 	})
 	var p probeMock
 	sup.AddProbe("p1", 15*time.Millisecond, ProbeFunc(p.UpdateState))
 	sup.Run(context.Background())
-	p.On("Read").Return(10, nil).Once()
-	expectedCurrent = State{}
-	time.Sleep(25 * time.Millisecond)
-	p.On("Read").Return(11, nil).Once()
-	expectedCurrent = State{data: map[string]interface{}{"_errors": Errors{}, "p1": 10}}
-	time.Sleep(20 * time.Millisecond)
-	p.On("Read").Return(12, nil).Once()
-	expectedCurrent = State{data: map[string]interface{}{"_errors": Errors{}, "p1": 11}}
-	time.Sleep(20 * time.Millisecond)
+	for _, val := range []int{10, 11, 12} {
+		p.On("Read").Return(val, nil).Once()
+		clock.advance(20 * time.Millisecond)
+		assert.Equal(t, val, (<-notified).Int("p1"), "current state mismatch")
+	}
 	p.On("Read").Return(0, fmt.Errorf("dummy")).Once()
-	expectedCurrent = State{data: map[string]interface{}{"_errors": Errors{}, "p1": 12}}
-	time.Sleep(20 * time.Millisecond)
-	sup.Stop()
+	clock.advance(20 * time.Millisecond)
+	assert.EqualError(t, (<-notified).Err("p1"), "dummy")
+	require.NoError(t, sup.Stop(context.Background()))
+	p.AssertExpectations(t)
+}
+
+func TestSupervisor_StopWaitsForLoop(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store), WithSamplingInterval(5*time.Millisecond))
+	sampling := make(chan struct{})
+	release := make(chan struct{})
+	sup.AddProbe("slow", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		select {
+		case sampling <- struct{}{}:
+			<-release
+		default:
+		}
+		mutation.Set("slow", true)
+	}))
+	sup.Run(context.Background())
+	<-sampling
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := sup.Stop(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	close(release)
+	require.NoError(t, sup.Stop(context.Background()))
+	points := store.Points()
+	require.NotEmpty(t, points)
+	// the interrupted tick has been saved before the shutdown marker
+	assert.Equal(t, "test", points[len(points)-2].Name)
+	assert.Equal(t, "test"+shutdownSuffix, points[len(points)-1].Name)
+}
+
+func TestSupervisor_RunExitsOnCancel(t *testing.T) {
+	store := NewMemStore()
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithStore(store), WithClock(clock))
+	sup.AddProbe("p1", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("p1", clock.Now().UnixNano())
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	sup.Run(ctx)
+	clock.advance(time.Second)
+	clock.advance(time.Second)
+	cancel()
+	select {
+	case <-sup.done:
+	case <-time.After(time.Second):
+		t.Fatal("sampling loop did not exit")
+	}
+	saved := len(store.Points())
+	assert.NotZero(t, saved)
+	select {
+	case clock.ticker <- clock.Now():
+		t.Fatal("loop still receives ticks")
+	default:
+	}
+	assert.Len(t, store.Points(), saved, "no state should be saved after the loop exited")
+}
+
+type closingProbe struct {
+	calls  int32
+	closed int32
+	err    error
+	block  chan struct{}
+}
+
+func (p *closingProbe) UpdateState(context.Context, *StateMutation) {
+	atomic.AddInt32(&p.calls, 1)
+}
+
+func (p *closingProbe) Close() error {
+	atomic.AddInt32(&p.closed, 1)
+	if p.block != nil {
+		<-p.block
+	}
+	return p.err
+}
+
+func TestSupervisor_StopClosesProbes(t *testing.T) {
+	sup := NewSupervisor("test", WithProbeCloseTimeout(50*time.Millisecond))
+	db := &closingProbe{}
+	failing := &closingProbe{err: errors.New("connection reset")}
+	wedged := &closingProbe{block: make(chan struct{})}
+	defer close(wedged.block)
+	member := &closingProbe{}
+	sup.AddProbe("db", time.Second, db)
+	sup.AddProbe("failing", time.Second, failing)
+	sup.AddProbe("wedged", time.Second, wedged)
+	sup.AddProbeGroup("group", time.Second, map[string]Probe{"member": member, "plain": ProbeFunc(func(context.Context, *StateMutation) {})})
+	sup.AddProbe("func", time.Second, ProbeFunc(func(context.Context, *StateMutation) {}))
+	sup.Run(context.Background())
+
+	start := time.Now()
+	require.NoError(t, sup.Stop(context.Background()))
+	assert.Less(t, time.Since(start), time.Second, "closers running past the timeout are abandoned")
+	require.NoError(t, sup.Stop(context.Background()))
+	for _, p := range []*closingProbe{db, failing, wedged, member} {
+		assert.EqualValues(t, 1, atomic.LoadInt32(&p.closed), "probes are closed once")
+	}
+}
+
+func TestSupervisor_StopDuringSampleNow(t *testing.T) {
+	sup := NewSupervisor("test")
+	started, release := make(chan struct{}), make(chan struct{})
+	db := &closingProbe{}
+	sup.AddProbe("db", time.Second, db)
+	sup.AddProbe("slow", time.Second, ProbeFunc(func(context.Context, *StateMutation) {
+		close(started)
+		<-release
+	}))
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		sup.SampleNow(context.Background())
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sup.Stop(ctx), context.DeadlineExceeded)
+	assert.Zero(t, atomic.LoadInt32(&db.closed), "probes in use are not closed")
+
+	close(release)
+	<-sampled
+	require.NoError(t, sup.Stop(context.Background()))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&db.closed), "probes are closed by the next Stop")
+}
+
+func TestSupervisor_SampleNowAfterStop(t *testing.T) {
+	sup := NewSupervisor("test")
+	db := &closingProbe{}
+	var plainCalls int32
+	sup.AddProbe("db", 0, db)
+	sup.AddProbe("plain", 0, ProbeFunc(func(context.Context, *StateMutation) { atomic.AddInt32(&plainCalls, 1) }))
+	require.NoError(t, sup.Stop(context.Background()))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&db.closed))
+
+	sup.SampleNow(context.Background())
+	assert.Zero(t, atomic.LoadInt32(&db.calls), "closed probes are not sampled")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&plainCalls))
+
+	replaced := &closingProbe{}
+	require.NoError(t, sup.ReplaceProbe("db", replaced))
+	sup.SampleNow(context.Background())
+	assert.EqualValues(t, 1, atomic.LoadInt32(&replaced.calls), "replaced probes are sampled again")
+}
+
+func TestSupervisor_SetSamplingInterval(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time), intervals: make(chan time.Duration, 1)}
+	sup := NewSupervisor("test", WithClock(clock), WithSamplingInterval(time.Hour))
+	sup.Run(context.Background())
+	assert.Equal(t, time.Hour, <-clock.intervals)
+
+	sup.SetSamplingInterval(5 * time.Millisecond)
+	assert.Equal(t, 5*time.Millisecond, <-clock.intervals)
+	sup.SetSamplingInterval(0)
+	assert.Equal(t, defaultSamplingInterval, <-clock.intervals, "non positive interval restores the default")
+	clock.advance(time.Second)
+	require.NoError(t, sup.Stop(context.Background()))
+	assert.EqualValues(t, 1, sup.Stats().Ticks)
+}
+
+func TestSupervisor_CtxListener(t *testing.T) {
+	sup := NewSupervisor("test", WithSamplingInterval(10*time.Millisecond))
+	var i int
+	sup.AddProbe("p1", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		i++
+		mutation.Set("p1", i)
+	}))
+	started := make(chan struct{}, 1)
+	cancelled := make(chan error, 1)
+	sup.AddCtxListener(func(ctx context.Context, current *State) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		select {
+		case cancelled <- ctx.Err():
+		default:
+		}
+	})
+	sup.Run(context.Background())
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("listener was not notified")
+	}
+	require.NoError(t, sup.Stop(context.Background()))
+	select {
+	case err := <-cancelled:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(time.Second):
+		t.Fatal("listener did not observe cancellation")
+	}
+}
+
+func TestSupervisor_CtxListenerPush(t *testing.T) {
+	sup := NewSupervisor("test")
+	pushed := make(chan context.Context, 1)
+	sup.AddCtxListener(func(ctx context.Context, current *State) {
+		pushed <- ctx
+	})
+	sup.Run(context.Background())
+	sup.Push("count", 1)
+	ctx := <-pushed
+	require.NoError(t, ctx.Err())
+	require.NoError(t, sup.Stop(context.Background()))
+	assert.Equal(t, context.Canceled, ctx.Err(), "pushes should notify with the sampling loop context")
+}
+
+func TestSupervisor_Unsubscribe(t *testing.T) {
+	sup := NewSupervisor("test")
+	var first, second, third int
+	unsubscribeFirst := sup.AddListener(func(current *State) {
+		first++
+	})
+	var unsubscribeSecond func()
+	unsubscribeSecond = sup.AddListener(func(current *State) {
+		second++
+		// unsubscribing during the notification must neither deadlock nor skip other listeners
+		unsubscribeSecond()
+	})
+	sup.AddListener(func(current *State) {
+		third++
+	})
+	sup.Push("key", 1)
+	assert.Equal(t, []int{1, 1, 1}, []int{first, second, third})
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	sup.Push("key", 2)
+	assert.Equal(t, []int{1, 1, 2}, []int{first, second, third})
+}
+
+func TestSupervisor_ListenerChanges(t *testing.T) {
+	sup := NewSupervisor("test")
+	var fail bool
+	var value int
+	errDown := errors.New("down")
+	sup.AddProbe("p1", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		if fail {
+			mutation.SetError("p1", errDown)
+			return
+		}
+		value++
+		mutation.Set("p1", value).SetError("p1", nil)
+	}))
+	var data, errs, any int
+	sup.AddListener(func(*State) { data++ }, DataChange)
+	sup.AddListener(func(*State) { errs++ }, ErrorChange)
+	sup.AddListener(func(*State) { any++ })
+	now := time.Now()
+	for _, f := range []bool{false, true, true, false} {
+		fail = f
+		now = now.Add(time.Second)
+		sup.tick(context.Background(), now)
+	}
+	assert.Equal(t, 2, data)
+	assert.Equal(t, 2, errs)
+	assert.Equal(t, 3, any)
+}
+
+func TestSupervisor_ListenerDebounce(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock), WithListenerDebounce(50*time.Millisecond))
+	var notified []int
+	sup.AddListener(func(current *State) {
+		notified = append(notified, current.Int("key"))
+	})
+	for i := 1; i <= 100; i++ {
+		sup.Push("key", i)
+	}
+	assert.Equal(t, []int{1}, notified)
+	clock.skip(50 * time.Millisecond)
+	assert.Equal(t, []int{1, 100}, notified, "trailing notification carries the latest state")
+
+	// the pending notification is dropped on Stop
+	sup.Run(context.Background())
+	sup.Push("key", 101)
+	require.NoError(t, sup.Stop(context.Background()))
+	clock.skip(time.Second)
+	assert.Equal(t, []int{1, 100}, notified)
+}
+
+func TestSupervisor_ErrListener(t *testing.T) {
+	sup := NewSupervisor("test")
+	fail := true
+	unsubscribe := sup.AddErrListener(func(*State) error {
+		if fail {
+			return errors.New("push failed")
+		}
+		return nil
+	})
+	sup.AddProbe("count", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.IncrInt("count", 1)
+	}))
+	st := sup.SampleNow(context.Background())
+	assert.EqualError(t, st.Err("listener.1"), "push failed")
+	rec := httptest.NewRecorder()
+	sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	fail = false
+	st = sup.SampleNow(context.Background())
+	assert.NoError(t, st.Err("listener.1"))
+
+	fail = true
+	sup.SampleNow(context.Background())
+	unsubscribe()
+	assert.False(t, sup.GetState().HasErrors(), "error is resolved when the listener is unregistered")
+}
+
+func TestSupervisor_KeysListener(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddProbe("net", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("net.rx", 10).Set("net.tx", 5)
+	}))
+	sup.AddProbe("events", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.IncrInt("events", 1)
+	}))
+	var notified [][]string
+	sup.AddKeysListener(func(current *State, keys []string) {
+		notified = append(notified, keys)
+	})
+	now := time.Now()
+	sup.tick(context.Background(), now)
+	sup.tick(context.Background(), now.Add(time.Second))
+	sup.Push("net.rx", 11)
+	assert.Equal(t, [][]string{{"events", "net.rx", "net.tx"}, {"events"}, {"net.rx"}}, notified)
+
+	debounced := NewSupervisor("test", WithListenerDebounce(50*time.Millisecond))
+	keys := make(chan []string, 4)
+	debounced.AddKeysListener(func(current *State, changed []string) {
+		keys <- changed
+	})
+	debounced.Push("a", 1)
+	debounced.Push("c", 1)
+	debounced.Push("b", 1)
+	debounced.Push("c", 2)
+	assert.Equal(t, []string{"a"}, <-keys)
+	select {
+	case changed := <-keys:
+		assert.Equal(t, []string{"b", "c"}, changed, "keys are coalesced into the trailing notification")
+	case <-time.After(time.Second):
+		t.Fatal("trailing notification missing")
+	}
+}
+
+func TestSupervisor_ChangeListener(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddProbe("net", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("net.rx", 10).Set("net.tx", 5)
+	}))
+	sup.AddProbe("events", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.IncrInt("events", 1)
+	}))
+	var notified [][]ChangeEvent
+	sup.AddChangeListener(func(current *State, events []ChangeEvent) {
+		notified = append(notified, events)
+	})
+	now := time.Now()
+	sup.tick(context.Background(), now)
+	sup.tick(context.Background(), now.Add(time.Second))
+	sup.Push("net.rx", 11)
+	sup.CollectError("disk", errors.New("full"))
+	assert.Equal(t, [][]ChangeEvent{
+		{{Key: "events", New: 1}, {Key: "net.rx", New: 10}, {Key: "net.tx", New: 5}},
+		{{Key: "events", Old: 1, New: 2}},
+		{{Key: "net.rx", Old: 10, New: 11}},
+	}, notified)
+
+	mutation := sup.GetState().With().Delete("net.tx").Set("net.rx", 11)
+	mutation.Apply()
+	assert.Equal(t, []ChangeEvent{{Key: "net.tx", Old: 5}}, mutation.Events())
+
+	debounced := NewSupervisor("test", WithListenerDebounce(50*time.Millisecond))
+	events := make(chan []ChangeEvent, 3)
+	debounced.AddChangeListener(func(current *State, changed []ChangeEvent) {
+		events <- changed
+	})
+	debounced.Push("a", 1)
+	debounced.Push("a", 2)
+	debounced.Push("a", 3)
+	assert.Equal(t, []ChangeEvent{{Key: "a", New: 1}}, <-events)
+	select {
+	case changed := <-events:
+		assert.Equal(t, []ChangeEvent{{Key: "a", Old: 1, New: 2}, {Key: "a", Old: 2, New: 3}}, changed)
+	case <-time.After(time.Second):
+		t.Fatal("trailing notification missing")
+	}
+}
+
+func TestSupervisor_SignificantKeys(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store), WithSignificantKeys(time.Minute, "signal"))
+	now := time.Now()
+	// nothing has been persisted yet so the state is stale
+	sup.persist(now, sup.state.With().Set("noise", 1))
+	assert.Len(t, store.Points(), 1)
+	now = now.Add(time.Second)
+	sup.persist(now, sup.state.With().Set("noise", 2))
+	assert.Len(t, store.Points(), 1, "noise only change should not be persisted")
+	now = now.Add(time.Second)
+	sup.persist(now, sup.state.With().Set("signal", true))
+	assert.Len(t, store.Points(), 2, "significant change should be persisted")
+	now = now.Add(30 * time.Second)
+	sup.persist(now, sup.state.With().Set("noise", 3))
+	assert.Len(t, store.Points(), 2)
+	now = now.Add(30 * time.Second)
+	sup.persist(now, sup.state.With().Set("noise", 4))
+	assert.Len(t, store.Points(), 3, "stale state should be persisted")
+}
+
+func TestSupervisor_StoreRetainsFields(t *testing.T) {
+	var batch []map[string]interface{}
+	store := writerFunc(func(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+		batch = append(batch, fields)
+		return nil
+	})
+	sup := NewSupervisor("test", WithStore(store))
+	for i := 1; i <= 2; i++ {
+		mutation := sup.state.With().Set("count", i).Set("disks", map[string]interface{}{"sda": i})
+		mutation.Apply()
+		sup.persist(time.Now(), mutation)
+	}
+	require.Len(t, batch, 2)
+	assert.Equal(t, map[string]interface{}{"count": 1, "disks": map[string]interface{}{"sda": 1}}, batch[0])
+	batch[1]["disks"].(map[string]interface{})["sda"] = 3
+	assert.Equal(t, map[string]interface{}{"sda": 2}, sup.GetState().Elem("disks"))
+}
+
+func TestSupervisor_SetAt(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store))
+	now := time.Now()
+	event := now.Add(-time.Hour)
+	mutation := sup.state.With().Set("count", 1).SetAt("event", "start", event)
+	mutation.Apply()
+	sup.persist(now, mutation)
+	ts, found := sup.GetState().Timestamp("event")
+	assert.True(t, found)
+	assert.Equal(t, event, ts)
+
+	points := store.Points()
+	require.Len(t, points, 2)
+	assert.Equal(t, event, points[0].Time)
+	assert.Equal(t, map[string]interface{}{"event": "start"}, points[0].Fields)
+	assert.Equal(t, now, points[1].Time, "values without a timestamp are saved at the tick time")
+	assert.Equal(t, map[string]interface{}{"count": 1}, points[1].Fields)
+
+	mutation = sup.state.With().SetAt("event", "start", now)
+	assert.Equal(t, []string{"event"}, mutation.ChangedKeys(), "new timestamp of the same value is a change")
+	mutation.Apply()
+	sup.state.With().Set("event", "start").Apply()
+	_, found = sup.GetState().Timestamp("event")
+	assert.False(t, found, "plain Set falls back to the tick time")
+}
+
+func TestSupervisor_RestoreSetAt(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store))
+	now := time.Now()
+	mutation := sup.state.With().Set("count", 1).SetAt("event", "start", now.Add(-time.Hour))
+	mutation.Apply()
+	sup.persist(now, mutation)
+	mutation = sup.state.With().Set("count", 2).SetAt("queue", 5, now.Add(-time.Minute))
+	mutation.Apply()
+	sup.persist(now.Add(time.Second), mutation)
+
+	restarted := NewSupervisor("test", WithStore(store))
+	require.NoError(t, restarted.Restore(context.Background()))
+	assert.Equal(t, map[string]interface{}{"count": 2, "event": "start", "queue": 5}, restarted.state.Snapshot(),
+		"values saved with their own timestamps are restored along with the last tick")
+}
+
+func TestSupervisor_PersistInterval(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store), WithPersistInterval(3*time.Second), WithPersistAggregation(AggregateMin, AggregateMax, AggregateAvg))
+	now := time.Now()
+	for i, temp := range []float64{20, 26, 22, 21, 30} {
+		mutation := sup.state.With().Set("temp", temp).Set("host", "rpi")
+		mutation.Apply()
+		sup.persist(now.Add(time.Duration(i)*time.Second), mutation)
+	}
+	points := store.Points()
+	require.Len(t, points, 2)
+	assert.Equal(t, map[string]interface{}{"temp": 20.0, "temp.min": 20.0, "temp.max": 20.0, "temp.avg": 20.0, "host": "rpi"}, points[0].Fields)
+	assert.Equal(t, map[string]interface{}{"temp": 21.0, "temp.min": 21.0, "temp.max": 26.0, "temp.avg": 23.0, "host": "rpi"}, points[1].Fields)
+}
+
+func TestSupervisor_PersistedErrors(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store), WithTags(map[string]string{"host": "rpi"}))
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	mutation := sup.state.With().Set("temp", 90.0).SetError("net", errors.New("down"))
+	mutation.Apply()
+	sup.persist(time.Now(), mutation)
+	p := store.Points()[0]
+	assert.Equal(t, map[string]interface{}{"temp": 90.0}, p.Fields)
+	assert.Equal(t, map[string]string{"host": "rpi"}, p.Tags)
+
+	sup = NewSupervisor("test", WithStore(store), WithPersistedErrors())
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	mutation = sup.state.With().Set("temp", 90.0).SetError("net", errors.New("down"))
+	mutation.Apply()
+	sup.persist(time.Now(), mutation)
+	p = store.Points()[1]
+	assert.Equal(t, map[string]interface{}{"temp": 90.0, "error.net": 1, "alert.temp": true}, p.Fields)
+}
+
+func TestSupervisor_StoreBackoff(t *testing.T) {
+	var saves int
+	failing := true
+	store := writerFunc(func(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+		saves++
+		if failing {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	sup := NewSupervisor("test", WithStore(store), WithStoreTimeout(time.Millisecond))
+	now := time.Now()
+	sup.persist(now, sup.state.With())
+	assert.Equal(t, 1, saves)
+	assert.EqualError(t, sup.state.Err(StoreErrorCode), "could not save state: connection refused")
+
+	// first backoff is one second and doubles with each failure
+	sup.persist(now.Add(500*time.Millisecond), sup.state.With())
+	assert.Equal(t, 1, saves)
+	sup.persist(now.Add(time.Second), sup.state.With())
+	assert.Equal(t, 2, saves)
+	sup.persist(now.Add(2500*time.Millisecond), sup.state.With())
+	assert.Equal(t, 2, saves)
+
+	failing = false
+	sup.persist(now.Add(3*time.Second), sup.state.With())
+	assert.Equal(t, 3, saves)
+	assert.NoError(t, sup.state.Err(StoreErrorCode))
+	sup.persist(now.Add(3100*time.Millisecond), sup.state.With())
+	assert.Equal(t, 4, saves)
+}
+
+func TestSupervisor_AsyncSave(t *testing.T) {
+	release := make(chan struct{})
+	var mx sync.Mutex
+	var saves int
+	store := writerFunc(func(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+		<-release
+		mx.Lock()
+		saves++
+		mx.Unlock()
+		return nil
+	})
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithStore(store), WithClock(clock))
+	sup.Run(context.Background())
+	// one snapshot is being saved and the queue is full once all but the last pass are over
+	for i := 0; i < storeQueueSize+3; i++ {
+		clock.advance(time.Second)
+	}
+	stats := sup.Stats()
+	assert.NotZero(t, stats.DroppedSaves, "blocked store should not block sampling")
+	assert.Greater(t, stats.Ticks, uint64(storeQueueSize))
+
+	close(release)
+	require.NoError(t, sup.Stop(context.Background()))
+	mx.Lock()
+	defer mx.Unlock()
+	// pending snapshots are saved before the shutdown marker
+	assert.GreaterOrEqual(t, saves, storeQueueSize+1)
+}
+
+func TestSupervisor_SampleNowDuringStopFailingStore(t *testing.T) {
+	saving, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	store := writerFunc(func(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+		once.Do(func() {
+			close(saving)
+			<-release
+		})
+		return errors.New("disk full")
+	})
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithStore(store), WithClock(clock))
+	sup.Run(context.Background())
+	clock.advance(time.Second)
+	<-saving
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- sup.Stop(context.Background())
+	}()
+	// the saver drains the queue while forced passes save synchronously
+	require.Eventually(t, func() bool {
+		sup.mx.Lock()
+		defer sup.mx.Unlock()
+		return sup.saves == nil
+	}, time.Second, time.Millisecond)
+	close(release)
+	clock.skip(time.Hour)
+	sup.SampleNow(context.Background())
+	assert.Error(t, <-stopped)
+	assert.Error(t, sup.GetState().Err(StoreErrorCode))
+}
+
+func TestSupervisor_CollectErrorSlowStore(t *testing.T) {
+	saving, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	store := writerFunc(func(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+		close(saving)
+		<-release
+		return nil
+	})
+	sup := NewSupervisor("test", WithStore(store))
+	go func() {
+		// synchronous tick persistence holds the supervisor lock
+		sup.mx.Lock()
+		defer sup.mx.Unlock()
+		sup.persist(time.Now(), sup.state.With())
+	}()
+	<-saving
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for i := 0; i < 100; i++ {
+			_ = sup.CollectError("api", fmt.Errorf("request %d failed", i))
+		}
+	}()
+	select {
+	case <-collected:
+	case <-time.After(time.Second):
+		t.Fatal("errors are not collected while the store is saving")
+	}
+	e, _ := sup.state.ErrorDetail("api")
+	assert.Equal(t, 100, e.Count)
+}
+
+func TestSupervisor_CollectErrorConcurrentReads(t *testing.T) {
+	sup := NewSupervisor("test")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = sup.CollectError(fmt.Sprintf("req-%d", i%3), errors.New("failed"))
+			_ = sup.CollectError(fmt.Sprintf("req-%d", i%3), nil)
+		}
+	}()
+	// run with -race to detect unguarded reads
+	for i := 0; i < 100; i++ {
+		sup.GetState().HasErrors()
+	}
+	<-done
+	assert.False(t, sup.GetState().HasErrors())
+}
+
+func TestSupervisor_CollectErrorPrecedence(t *testing.T) {
+	sup := NewSupervisor("test")
+	var probeErr error
+	sup.AddProbe("db", 0, ErrProbeFunc(func(ctx context.Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"db.connections": 3}, probeErr
+	}))
+	manual := errors.New("replica lag too high")
+	_ = sup.CollectError("db", manual)
+
+	sup.tick(context.Background(), time.Now())
+	assert.ErrorIs(t, sup.GetState().Err("db"), manual, "successful sampling must not clear a collected error")
+	probeErr = errors.New("connection refused")
+	sup.tick(context.Background(), time.Now().Add(time.Second))
+	assert.ErrorIs(t, sup.GetState().Err("db"), manual, "probe error must not overwrite a collected error")
+
+	_ = sup.CollectError("db", nil)
+	assert.NoError(t, sup.GetState().Err("db"))
+	sup.tick(context.Background(), time.Now().Add(2*time.Second))
+	assert.EqualError(t, sup.GetState().Err("db"), "connection refused")
+	probeErr = nil
+	sup.tick(context.Background(), time.Now().Add(3*time.Second))
+	assert.NoError(t, sup.GetState().Err("db"))
+}
+
+func TestSupervisor_MaxErrors(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithMaxErrors(2), WithClock(clock))
+	for _, code := range []string{"req-1", "req-2", "req-1", "req-3"} {
+		_ = sup.CollectError(code, errors.New("failed"))
+		clock.skip(time.Millisecond)
+	}
+	state := sup.GetState()
+	assert.Error(t, state.Err("req-1"))
+	assert.NoError(t, state.Err("req-2"), "least recently seen error should be evicted")
+	assert.Error(t, state.Err("req-3"))
+	assert.EqualValues(t, 1, sup.Stats().EvictedErrors)
+}
+
+func TestSupervisor_Alerts(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	sup.AddAlert("online", NewInverseBoolAlert(AlertStrategyLatch))
+	mutation := sup.state.With()
+	mutation.Set("temp", 85.0).Set("online", true)
+	mutation.Apply()
+
+	alerts := sup.Alerts()
+	assert.Len(t, alerts, 2)
+	temp := alerts["temp"]
+	assert.Equal(t, "temp", temp.ID)
+	assert.Equal(t, "temp", temp.Metric)
+	assert.Equal(t, ">=", temp.Operator)
+	assert.Equal(t, 80.0, temp.Threshold)
+	assert.True(t, temp.IsSet)
+	assert.False(t, temp.Since.IsZero())
+
+	online, found := sup.Alert("online")
+	assert.True(t, found)
+	assert.Equal(t, AlertInfo{ID: "online", Metric: "online", Operator: "==", Threshold: false}, online)
+
+	_, found = sup.Alert("unknown")
+	assert.False(t, found)
+}
+
+func TestSupervisor_ActiveAlerts(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddAlerts(map[string]*Alert{
+		"temp":      NewMaxFloatAlert(80, AlertStrategyClear),
+		"load-high": NewThresholdAlert("load", OpGreater, 4, AlertStrategyClear, WithMessage("system overloaded")),
+		"online":    NewBoolAlert(AlertStrategyClear),
+	})
+	sup.state.With().Set("temp", 90.0).Set("load", 5.0).Set("online", false).Apply()
+	assert.True(t, sup.AlertActive("temp"))
+	assert.False(t, sup.AlertActive("online"))
+	assert.False(t, sup.AlertActive("unknown"))
+	assert.Equal(t, []string{"load-high", "temp"}, sup.ActiveAlerts())
+
+	out, err := json.Marshal(sup.state.alerts["load-high"])
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"id":"load-high","metric":"load","active":true`)
+	assert.Contains(t, string(out), `"message":"system overloaded"`)
+}
+
+func TestSupervisor_AddAlertConcurrentState(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.Push("temp", 90.0)
+	handler := sup.HTTPHandler()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			sup.AddAlert(fmt.Sprintf("temp-%d", i), NewMaxFloatAlert(80, AlertStrategyClear))
+			sup.AddAlerts(map[string]*Alert{fmt.Sprintf("load-%d", i): NewMaxFloatAlert(4, AlertStrategyClear)})
+		}
+	}()
+	for served := false; !served; {
+		select {
+		case <-done:
+			served = true
+		default:
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	assert.Len(t, sup.Alerts(), 100)
+}
+
+func TestSupervisor_ExprAlert(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddAlert("overloaded", NewExprAlert(func(s *State) bool {
+		return s.Float("error_rate") > 0.05 && s.Int("qps") > 100
+	}))
+	sup.state.With().Set("error_rate", 0.1).Set("qps", 50).Apply()
+	assert.False(t, sup.AlertActive("overloaded"))
+	sup.state.With().Set("qps", 200).Apply()
+	assert.True(t, sup.AlertActive("overloaded"))
+	alert, _ := sup.Alert("overloaded")
+	assert.Equal(t, "expr", alert.Operator)
+	sup.state.With().Set("error_rate", 0.01).Apply()
+	assert.False(t, sup.AlertActive("overloaded"))
+}
+
+func TestSupervisor_ThresholdAlert(t *testing.T) {
+	tests := []struct {
+		op    ComparisonOp
+		val   interface{}
+		isSet bool
+	}{
+		{OpGreater, 10, false},
+		{OpGreater, 11, true},
+		{OpGreaterOrEqual, 10.0, true},
+		{OpLess, uint(9), true},
+		{OpLessOrEqual, 11, false},
+		{OpEqual, int64(10), true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v %s", test.val, test.op), func(t *testing.T) {
+			sup := NewSupervisor("test")
+			sup.AddAlert("load-high", NewThresholdAlert("load", test.op, 10, AlertStrategyClear))
+			sup.state.With().Set("load", test.val).Apply()
+			alert, _ := sup.Alert("load-high")
+			assert.Equal(t, test.isSet, alert.IsSet)
+			assert.Equal(t, "load", alert.Metric)
+			assert.Equal(t, string(test.op), alert.Operator)
+			assert.False(t, alert.Unknown)
+		})
+	}
+
+	sup := NewSupervisor("test")
+	sup.AddAlert("load-high", NewThresholdAlert("load", OpGreater, 10, AlertStrategyClear))
+	sup.state.With().Set("load", 20).Apply()
+	sup.state.With().Set("load", "n/a").Apply()
+	alert, _ := sup.Alert("load-high")
+	assert.True(t, alert.Unknown)
+	assert.True(t, alert.IsSet, "unknown value should keep the previous state")
+	assert.Panics(t, func() { NewThresholdAlert("load", "!=", 10, AlertStrategyClear) })
+}
+
+func TestSupervisor_AlertNotifier(t *testing.T) {
+	var transitions []bool
+	sup := NewSupervisor("test", WithAlertNotifier(func(id string, a *Alert, active bool) {
+		assert.Equal(t, "temp", id)
+		transitions = append(transitions, active)
+	}))
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	for _, temp := range []float64{70, 85, 90, 95, 60, 50, 81} {
+		sup.state.With().Set("temp", temp).Apply()
+	}
+	assert.Equal(t, []bool{true, false, true}, transitions)
+}
+
+func TestSupervisor_AlertHysteresis(t *testing.T) {
+	transitions := make(map[string][]bool)
+	sup := NewSupervisor("test", WithAlertNotifier(func(id string, a *Alert, active bool) {
+		transitions[id] = append(transitions[id], active)
+	}))
+	sup.AddAlert("temp-high", NewThresholdAlert("temp", OpGreater, 80, AlertStrategyClear, WithHysteresis(2)))
+	sup.AddAlert("temp-low", NewThresholdAlert("temp", OpLess, 10, AlertStrategyClear, WithHysteresis(2)))
+	for _, temp := range []float64{79, 81, 79.5, 80.5, 78.5, 77.9, 79, 81} {
+		sup.state.With().Set("temp", temp).Apply()
+	}
+	assert.Equal(t, map[string][]bool{"temp-high": {true, false, true}}, transitions)
+
+	for _, temp := range []float64{9, 11, 11.9, 12} {
+		sup.state.With().Set("temp", temp).Apply()
+	}
+	assert.Equal(t, []bool{true, false, true, false}, transitions["temp-high"])
+	assert.Equal(t, []bool{true, false}, transitions["temp-low"])
+	info, _ := sup.Alert("temp-low")
+	assert.Equal(t, 2.0, info.Hysteresis)
+
+	sup.AddAlert("load", NewMaxFloatAlert(4, AlertStrategyClear, WithHysteresis(0.5)))
+	for _, load := range []float64{4.2, 3.8, 3.4} {
+		sup.state.With().Set("load", load).Apply()
+	}
+	assert.Equal(t, []bool{true, false}, transitions["load"], "max float alerts clear past the band")
+}
+
+func TestSupervisor_AlertCooldown(t *testing.T) {
+	var transitions []bool
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock), WithAlertNotifier(func(id string, a *Alert, active bool) {
+		transitions = append(transitions, active)
+	}))
+	sup.AddAlert("temp", NewThresholdAlert("temp", OpGreater, 80, AlertStrategyClear, WithCooldown(50*time.Millisecond)))
+	for _, temp := range []float64{85, 60, 85, 60} {
+		sup.state.With().Set("temp", temp).Apply()
+	}
+	assert.Equal(t, []bool{true}, transitions, "flapping within the cooldown is not notified")
+	clock.skip(60 * time.Millisecond)
+	sup.state.With().Set("other", 1).Apply()
+	assert.Equal(t, []bool{true, false}, transitions, "final status is notified after the cooldown")
+
+	for _, temp := range []float64{85, 60} {
+		sup.state.With().Set("temp", temp).Apply()
+	}
+	clock.skip(60 * time.Millisecond)
+	sup.state.With().Set("other", 2).Apply()
+	assert.Equal(t, []bool{true, false}, transitions, "status matching the notified one is not repeated")
+	sup.state.With().Set("temp", 85.0).Apply()
+	assert.Equal(t, []bool{true, false, true}, transitions)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	events := make(chan map[string]interface{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		events <- event
+	}))
+	defer srv.Close()
+	sup := NewSupervisor("test", WithAlertNotifier(WebhookNotifier(srv.URL)))
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	sup.state.With().Set("temp", 85.0).Apply()
+	select {
+	case event := <-events:
+		assert.Equal(t, "temp", event["id"])
+		assert.Equal(t, true, event["isSet"])
+		assert.Equal(t, "alert temp is active: temp >= 80", event["text"])
+		assert.Equal(t, "temp", event["dedupKey"])
+		assert.Equal(t, "error", event["severity"])
+	case <-time.After(time.Second):
+		t.Fatal("webhook was not called")
+	}
+
+	sup.AddAlert("disk", NewThresholdAlert("disk", OpGreater, 90, AlertStrategyClear, WithSeverity(SeverityCritical),
+		WithRunbookURL("https://runbooks.example.com/disk"), WithLabels(map[string]string{"team": "infra", "host": "a"})))
+	sup.state.With().Set("disk", 95.0).Apply()
+	select {
+	case event := <-events:
+		assert.Equal(t, "disk", event["id"])
+		assert.Equal(t, "disk{host=a,team=infra}", event["dedupKey"])
+		assert.Equal(t, "critical", event["severity"])
+		assert.Equal(t, "https://runbooks.example.com/disk", event["runbookUrl"])
+		assert.Equal(t, map[string]interface{}{"team": "infra", "host": "a"}, event["labels"])
+	case <-time.After(time.Second):
+		t.Fatal("webhook was not called")
+	}
+	info, _ := sup.Alert("disk")
+	assert.Equal(t, SeverityCritical, info.Severity)
+	out, err := json.Marshal(sup.state.alerts["disk"])
+	require.NoError(t, err)
+	assert.Contains(t, string(out), `"severity":"critical","runbookUrl":"https://runbooks.example.com/disk","labels":{"host":"a","team":"infra"}`)
+}
+
+// logLines passes log entries written by zerolog to a channel dropping them once it is full
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	select {
+	case l <- string(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestWebhookNotifier_Logger(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	lines := make(logLines, 1)
+	logger := zerolog.New(lines)
+	notify := WebhookNotifier(srv.URL, WithWebhookLogger(&logger))
+	notify("temp", NewMaxFloatAlert(80, AlertStrategyClear), true)
+	select {
+	case line := <-lines:
+		assert.Contains(t, line, `"status":502,"alert":"temp","message":"alert notification rejected"`)
+	case <-time.After(time.Second):
+		t.Fatal("rejected notification was not logged")
+	}
+}
+
+func TestSupervisor_ErrProbeFunc(t *testing.T) {
+	sup := NewSupervisor("test")
+	var err error
+	sup.AddProbe("disk", 0, ErrProbeFunc(func(ctx context.Context) (map[string]interface{}, error) {
+		return map[string]interface{}{"disk.free": 10}, err
+	}))
+	now := time.Now()
+	sup.tick(context.Background(), now)
+	assert.Equal(t, 10, sup.GetState().Int("disk.free"))
+	assert.NoError(t, sup.GetState().Err("disk"))
+
+	err = errors.New("not mounted")
+	sup.tick(context.Background(), now.Add(time.Second))
+	assert.Equal(t, err, sup.GetState().getError("disk"))
+
+	err = nil
+	sup.tick(context.Background(), now.Add(2*time.Second))
+	assert.NoError(t, sup.GetState().Err("disk"))
+}
+
+func TestSupervisor_ProbeJitter(t *testing.T) {
+	sup := NewSupervisor("test", WithProbeJitter(0.9))
+	var mx sync.Mutex
+	firstRun := make(map[string]int)
+	tick := 0
+	specs := make(map[string]ProbeSpec)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("p%d", i)
+		specs[name] = ProbeSpec{Interval: time.Second, Probe: ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+			mx.Lock()
+			defer mx.Unlock()
+			if _, found := firstRun[name]; !found {
+				firstRun[name] = tick
+			}
+		})}
+	}
+	sup.AddProbes(specs)
+	now := time.Now()
+	for ; tick <= 10; tick++ {
+		sup.tick(context.Background(), now.Add(time.Duration(tick)*100*time.Millisecond))
+	}
+	require.Len(t, firstRun, 10, "every probe should run within its interval")
+	ticks := make(map[int]bool)
+	for _, tick := range firstRun {
+		ticks[tick] = true
+	}
+	assert.Greater(t, len(ticks), 1, "probes should not all run on the same tick")
+}
+
+func TestMetric_RetriesPerTick(t *testing.T) {
+	var calls int
+	flaky := ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		calls++
+		if calls%2 == 1 {
+			mutation.SetError("flaky", fmt.Errorf("connection reset"))
+			return
+		}
+		mutation.SetError("flaky", nil)
+		mutation.Set("flaky", 42)
+	})
+
+	state := &State{data: map[string]interface{}{}}
+	mutation := state.With()
+	NewMetric("flaky", 0, flaky, RetriesPerTick(2, time.Millisecond)).updateState(context.Background(), mutation)
+	mutation.Apply()
+	assert.Equal(t, 2, calls)
+	assert.NoError(t, state.Err("flaky"))
+	assert.Equal(t, 42, state.Int("flaky"))
+
+	calls = 0
+	state = &State{data: map[string]interface{}{}}
+	mutation = state.With()
+	NewMetric("flaky", 0, flaky).updateState(context.Background(), mutation)
+	mutation.Apply()
+	assert.Equal(t, 1, calls)
+	assert.EqualError(t, state.Err("flaky"), "connection reset")
+}
+
+func TestSupervisor_Stats(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock))
+	sup.AddProbe("fast", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {}))
+	sup.AddProbe("slow", time.Hour, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {}))
+	sup.Run(context.Background())
+	for i := 0; i < 3; i++ {
+		clock.advance(time.Second)
+	}
+	require.NoError(t, sup.Stop(context.Background()))
+
+	stats := sup.Stats()
+	assert.EqualValues(t, 3, stats.Ticks)
+	assert.Equal(t, stats.Ticks+1, stats.ProbesRun)
+	assert.Equal(t, stats.Ticks-1, stats.ProbesSkipped)
+	assert.Zero(t, stats.DroppedTicks)
+	assert.True(t, stats.AvgTickDuration > 0)
+	assert.True(t, stats.MaxTickDuration >= stats.AvgTickDuration)
+	assert.False(t, stats.LastTick.IsZero())
+	assert.False(t, stats.StartTime.IsZero())
+	assert.True(t, stats.Uptime >= stats.LastTick.Sub(stats.StartTime))
+
+	var payload struct {
+		Meta struct {
+			StartTime time.Time     `json:"startTime"`
+			Uptime    time.Duration `json:"uptime"`
+			Ticks     uint64        `json:"ticks"`
+		} `json:"meta"`
+	}
+	data, err := json.Marshal(sup.GetState())
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &payload))
+	assert.Equal(t, stats.Ticks, payload.Meta.Ticks)
+	assert.True(t, stats.StartTime.Equal(payload.Meta.StartTime))
+	assert.NotZero(t, payload.Meta.Uptime)
+}
+
+func TestSamplerStats_DroppedTicks(t *testing.T) {
+	var stats SamplerStats
+	now := time.Now()
+	for _, gap := range []time.Duration{0, 10, 14, 16, 30, 41} {
+		now = now.Add(gap * time.Millisecond)
+		stats.record(now, 0, 10*time.Millisecond, 0, 0)
+	}
+	// 16ms gap drops one tick, 30ms two and 41ms three
+	assert.EqualValues(t, 6, stats.DroppedTicks)
+	assert.EqualValues(t, 6, stats.Ticks)
+}
+
+func TestSupervisor_AccumulateDelta(t *testing.T) {
+	sup := NewSupervisor("test")
+	deltas := []int{3, 0, 3, 4}
+	var i int
+	sup.AddProbe("events", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("events_delta", deltas[i])
+		i++
+	}))
+	sup.AccumulateDelta("events_delta", "events_total")
+	now := time.Now()
+	for range deltas {
+		now = now.Add(time.Second)
+		sup.tick(context.Background(), now)
+	}
+	assert.Equal(t, 10, sup.state.Int("events_total"))
+	assert.Nil(t, sup.state.Elem("events_delta"))
+	assert.NoError(t, sup.state.Err("events_delta"))
+}
+
+func TestSupervisor_ReplaceProbe(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddProbe("version", time.Minute, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("version", 1)
+	}))
+	now := time.Now()
+	sup.tick(context.Background(), now)
+	assert.Equal(t, 1, sup.state.Int("version"))
+
+	err := sup.ReplaceProbe("version", ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("version", 2)
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, now, sup.metrics["version"].lastUpdate)
+	// cadence is preserved so the new probe waits for its turn
+	sup.tick(context.Background(), now.Add(time.Second))
+	assert.Equal(t, 1, sup.state.Int("version"))
+	sup.tick(context.Background(), now.Add(2*time.Minute))
+	assert.Equal(t, 2, sup.state.Int("version"))
+
+	assert.True(t, errors.Is(sup.ReplaceProbe("unknown", ProbeFunc(nil)), ErrUnknownMetric))
+	assert.Error(t, sup.ReplaceProbe("version", "invalid"))
+}
+
+func TestSupervisor_HandlerStateGzip(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.Push("count", 1)
+	handler := sup.HTTPHandler()
+	get := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/state", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("gzip, deflate")
+	assert.Empty(t, rec.Header().Get("Content-Encoding"), "small payloads should not be compressed")
+	assert.JSONEq(t, `{"state":{"count":1},"meta":{"version":1}}`, rec.Body.String())
+
+	mutation := sup.state.With()
+	for i := 0; i < 100; i++ {
+		mutation.Set(fmt.Sprintf("sensor.%d", i), i)
+	}
+	mutation.Apply()
+	rec = get("gzip, deflate")
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, JSONContentType, rec.Header().Get("Content-Type"))
+	zr, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	var payload struct {
+		State map[string]interface{} `json:"state"`
+	}
+	require.NoError(t, json.NewDecoder(zr).Decode(&payload))
+	assert.Len(t, payload.State, 101)
+
+	assert.Empty(t, get("gzip;q=0, identity").Header().Get("Content-Encoding"))
+	assert.Empty(t, get("").Header().Get("Content-Encoding"))
+}
+
+func TestSupervisor_HandlerStateETag(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.Push("count", 1)
+	handler := sup.HTTPHandler()
+	get := func(accept, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/state", nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	assert.True(t, strings.HasPrefix(etag, `W/"`), etag)
+
+	rec = get("", etag)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	assert.Equal(t, http.StatusOK, get(YAMLContentType, etag).Code, "representations should be tagged separately")
+
+	sup.Push("count", 1)
+	assert.Equal(t, http.StatusNotModified, get("", etag).Code, "unchanged state should keep the tag")
+	sup.Push("count", 2)
+	rec = get("", etag)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+	etag = rec.Header().Get("ETag")
+	_ = sup.CollectError("net", errors.New("down"))
+	rec = get("", `"other", `+etag)
+	assert.Equal(t, http.StatusOK, rec.Code, "errors should change the tag")
+	etag = rec.Header().Get("ETag")
+
+	// run metadata changing without a version bump is not served with a tag
+	sup.state.setMeta(&runMeta{StartTime: time.Now(), Ticks: 1})
+	rec = get("", "")
+	assert.Equal(t, etag, rec.Header().Get("ETag"))
+	assert.NotContains(t, rec.Body.String(), "ticks")
+	assert.NotContains(t, rec.Body.String(), "uptime")
+	sup.state.setMeta(&runMeta{StartTime: time.Now(), Ticks: 2})
+	assert.Equal(t, http.StatusNotModified, get("", etag).Code)
+}
+
+func TestSupervisor_HandlerStateNegotiation(t *testing.T) {
+	sup := NewSupervisor("test")
+	mutation := sup.state.With()
+	mutation.Set("count", 3).Set("name", "gockpit")
+	mutation.Apply()
+	handler := sup.HTTPHandler()
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/state", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	expected := map[string]interface{}{"count": 3, "name": "gockpit"}
+
+	rec := get("")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, JSONContentType, rec.Header().Get("Content-Type"))
+	var fromJSON struct {
+		State map[string]interface{} `json:"state"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &fromJSON))
+	assert.Equal(t, map[string]interface{}{"count": 3.0, "name": "gockpit"}, fromJSON.State)
+
+	rec = get("application/yaml")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, YAMLContentType, rec.Header().Get("Content-Type"))
+	var fromYAML struct {
+		State map[string]interface{} `yaml:"state"`
+	}
+	require.NoError(t, yaml.Unmarshal(rec.Body.Bytes(), &fromYAML))
+	assert.Equal(t, expected, fromYAML.State)
+
+	rec = get("text/html;q=0.9, application/msgpack")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, MsgpackContentType, rec.Header().Get("Content-Type"))
+	var fromMsgpack struct {
+		State map[string]interface{} `msgpack:"state"`
+	}
+	require.NoError(t, msgpack.Unmarshal(rec.Body.Bytes(), &fromMsgpack))
+	assert.EqualValues(t, 3, fromMsgpack.State["count"])
+	assert.Equal(t, "gockpit", fromMsgpack.State["name"])
+
+	rec = get("text/csv")
+	assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+}
+
+func TestSupervisor_PushLimit(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock), WithPushLimit(5, 50*time.Millisecond))
+	var notifications int
+	sup.AddListener(func(current *State) {
+		notifications++
+	})
+	for i := 1; i <= 10000; i++ {
+		sup.Push("events", i)
+	}
+	assert.Equal(t, 5, notifications)
+	assert.Equal(t, 5, sup.state.Int("events"))
+
+	// the latest value is applied when the window closes
+	clock.skip(50 * time.Millisecond)
+	assert.Equal(t, 6, notifications)
+	assert.Equal(t, 10000, sup.state.Int("events"))
+	assert.EqualValues(t, 10000-6, sup.Stats().DroppedPushes)
+
+	clock.skip(time.Second)
+	sup.Push("events", 1)
+	assert.Equal(t, 7, notifications, "pushes in a new window are applied right away")
+}
+
+func TestSupervisor_Set(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock), WithPushLimit(1, 50*time.Millisecond))
+	var notifications int32
+	sup.AddListener(func(current *State) {
+		atomic.AddInt32(&notifications, 1)
+	})
+	sup.AddProbe("counter", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("ticks", 1)
+	}))
+	sup.Run(context.Background())
+	defer sup.Stop(context.Background())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				sup.Set(fmt.Sprintf("worker.%d", i), j)
+			}
+		}(i)
+	}
+	clock.advance(time.Second)
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, 99, sup.state.Int(fmt.Sprintf("worker.%d", i)))
+	}
+	// the loop receives the next tick once the previous pass is over
+	clock.advance(time.Second)
+	assert.Equal(t, 1, sup.state.Int("ticks"))
+
+	version := sup.state.Version()
+	before := atomic.LoadInt32(&notifications)
+	sup.Set("worker.0", 99)
+	assert.Equal(t, version, sup.state.Version(), "unchanged value should not bump the version")
+	assert.Equal(t, before, atomic.LoadInt32(&notifications))
+	sup.Set("worker.0", 100)
+	assert.True(t, sup.state.Version() > version)
+	assert.Equal(t, before+1, atomic.LoadInt32(&notifications))
+
+	// a value postponed by the push limit does not overwrite the one set afterwards
+	sup.Push("last", 1)
+	sup.Push("last", 2)
+	sup.Set("last", 3)
+	clock.skip(time.Second)
+	assert.Equal(t, 3, sup.state.Int("last"))
+}
+
+func TestSupervisor_RemoveProbe(t *testing.T) {
+	sup := NewSupervisor("test")
+	var calls int
+	sup.AddProbe("gpu", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		calls++
+		mutation.SetError("gpu", fmt.Errorf("device not found"))
+	}))
+	now := time.Now()
+	sup.tick(context.Background(), now)
+	assert.Equal(t, 1, calls)
+	assert.Error(t, sup.state.Err("gpu"))
+
+	sup.RemoveProbe("gpu")
+	sup.tick(context.Background(), now.Add(time.Second))
+	assert.Equal(t, 1, calls)
+	assert.NoError(t, sup.state.Err("gpu"))
+	assert.False(t, sup.state.HasErrors())
+}
+
+func TestSupervisor_Schema(t *testing.T) {
+	sup := NewSupervisor("test")
+	noop := ProbeFunc(func(ctx context.Context, mutation *StateMutation) {})
+	sup.AddProbe("temp", time.Second, noop, ExpectedRange(0, 100, 70, 90))
+	sup.AddProbe("uptime", time.Minute, noop)
+
+	assert.Equal(t, map[string]MetricSchema{
+		"temp":   {Name: "temp", Interval: time.Second, Range: &Range{Min: 0, Max: 100, Warn: 70, Crit: 90}},
+		"uptime": {Name: "uptime", Interval: time.Minute},
+	}, sup.Schema())
+
+	rec := httptest.NewRecorder()
+	sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schema", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"range":{"min":0,"max":100,"warn":70,"crit":90}`)
+}
+
+func TestSupervisor_AddProbes(t *testing.T) {
+	sup := NewSupervisor("test")
+	probe := ProbeFunc(func(ctx context.Context, mutation *StateMutation) {})
+	sup.AddProbes(map[string]ProbeSpec{
+		"a": {Interval: time.Second, Probe: probe},
+		"b": {Interval: time.Minute, Probe: probe, Options: []MetricOption{ExpectedRange(0, 10, 5, 8)}},
+	})
+	schema := sup.Schema()
+	assert.Len(t, schema, 2)
+	assert.Equal(t, time.Minute, schema["b"].Interval)
+	assert.NotNil(t, schema["b"].Range)
+
+	assert.Panics(t, func() {
+		sup.AddProbes(map[string]ProbeSpec{"c": {Probe: probe}, "d": {Probe: "invalid"}})
+	})
+	assert.Len(t, sup.Schema(), 2, "nothing should be registered if any probe is invalid")
+
+	sup.AddAlerts(map[string]*Alert{
+		"a": NewBoolAlert(AlertStrategyClear),
+		"b": NewMaxFloatAlert(9, AlertStrategyClear),
+	})
+	assert.Len(t, sup.Alerts(), 2)
+}
+
+func TestSupervisor_HandlerStateCSV(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.Push("count", 3)
+	rec := httptest.NewRecorder()
+	sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/state.csv", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, CSVContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "key,value\ncount,3\n", rec.Body.String())
+}
+
+func TestSupervisor_HandlerStateKeys(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddAlert("latency", NewThresholdAlert("latency", OpGreater, 100, AlertStrategyClear))
+	sup.state.With().Set("qps", 10).Set("latency", 120).Set("memory", 512).
+		SetError("latency", errors.New("slow")).SetError("disk", errors.New("full")).Apply()
+	get := func(path string) string {
+		rec := httptest.NewRecorder()
+		sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	var body struct {
+		State  map[string]interface{} `json:"state"`
+		Errors map[string]interface{} `json:"errors"`
+		Alerts map[string]interface{} `json:"alerts"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(get("/state?keys=qps,%20latency,unknown")), &body))
+	assert.Equal(t, map[string]interface{}{"qps": 10.0, "latency": 120.0}, body.State)
+	assert.Len(t, body.Errors, 1)
+	assert.Contains(t, body.Errors, "latency")
+	assert.Contains(t, body.Alerts, "latency")
+
+	body.State = nil
+	require.NoError(t, json.Unmarshal([]byte(get("/state?keys=")), &body))
+	assert.Len(t, body.State, 3, "empty keys return the whole state")
+	assert.Equal(t, "key,value\nqps,10\n", get("/state.csv?keys=qps"))
+}
+
+func TestSupervisor_HandlerHistory(t *testing.T) {
+	history := func(sup *Supervisor, query string) (int, string) {
+		rec := httptest.NewRecorder()
+		sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history"+query, nil))
+		return rec.Code, rec.Body.String()
+	}
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store))
+	now := time.Now()
+	for i, temp := range []float64{20, 21, 22} {
+		mutation := sup.state.With().Set("temp", temp)
+		if i == 1 {
+			mutation.Delete("temp")
+		}
+		mutation.Apply()
+		sup.persist(now.Add(time.Duration(i)*time.Second), mutation)
+	}
+	points, err := sup.History(context.Background(), "temp", time.Minute)
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+	assert.Equal(t, 20.0, points[0].Value)
+	assert.Equal(t, 22.0, points[1].Value)
+
+	code, body := history(sup, "?metric=temp&since=1m&limit=1")
+	assert.Equal(t, http.StatusOK, code)
+	var limited []HistoryPoint
+	require.NoError(t, json.Unmarshal([]byte(body), &limited))
+	require.Len(t, limited, 1)
+	assert.Equal(t, 22.0, limited[0].Value)
+
+	code, _ = history(sup, "?metric=temp&since=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = history(sup, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = history(NewSupervisor("test"), "?metric=temp")
+	assert.Equal(t, http.StatusNotImplemented, code)
+	assert.Contains(t, body, ErrNoReader.Error())
+}
+
+func TestSupervisor_HTTPMiddleware(t *testing.T) {
+	auth := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	handler := NewSupervisor("test", WithHTTPMiddleware(auth)).HTTPHandler()
+	for _, path := range []string{"/state", "/metrics", "/health"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, path)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/state", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestSupervisor_Health(t *testing.T) {
+	health := func(sup *Supervisor) (int, string) {
+		rec := httptest.NewRecorder()
+		sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	sup := NewSupervisor("test")
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	code, body := health(sup)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, `{"status":"ok"}`, body)
+
+	sup.state.With().Set("temp", 90.0).SetError("net", errors.New("down")).SetError("disk", errors.New("full")).Apply()
+	code, body = health(sup)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, `{"status":"unhealthy","errors":["disk","net"],"alerts":["temp"]}`, body)
+
+	sup = NewSupervisor("test", WithHealthErrorCodes([]string{"disk"}))
+	sup.state.With().SetError("net", errors.New("down")).Apply()
+	code, _ = health(sup)
+	assert.Equal(t, http.StatusOK, code)
+	sup.state.With().SetError("disk", errors.New("full")).Apply()
+	code, body = health(sup)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, `{"status":"unhealthy","errors":["disk"]}`, body)
+}
+
+func TestSupervisor_HealthSeverity(t *testing.T) {
+	health := func(sup *Supervisor, query string) (int, string) {
+		rec := httptest.NewRecorder()
+		sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health"+query, nil))
+		return rec.Code, strings.TrimSpace(rec.Body.String())
+	}
+	sup := NewSupervisor("test")
+	sup.state.With().SetErrorLevel("cache", SeverityWarn, errors.New("cold")).SetErrorLevel("disk", SeverityCritical, errors.New("full")).Apply()
+	assert.True(t, sup.GetState().HasErrorsAtLeast(SeverityCritical))
+	e, found := sup.GetState().ErrorDetail("cache")
+	require.True(t, found)
+	assert.Equal(t, SeverityWarn, e.Severity)
+
+	sup.AddProbe("link", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.SetErrorLevel("link", SeverityWarn, errors.New("degraded"))
+	}))
+	sup.SampleNow(context.Background())
+	e, _ = sup.GetState().ErrorDetail("link")
+	assert.Equal(t, SeverityWarn, e.Severity, "probe reported severity is kept")
+	sup.RemoveProbe("link")
+
+	code, body := health(sup, "")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, `{"status":"unhealthy","errors":["cache","disk"]}`, body)
+	code, body = health(sup, "?severity=error")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, `{"status":"unhealthy","errors":["disk"]}`, body)
+	code, _ = health(sup, "?severity=bogus")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	sup.state.With().SetError("disk", nil).Apply()
+	assert.False(t, sup.GetState().HasErrorsAtLeast(SeverityError))
+	_ = sup.CollectErrorLevel("link", SeverityInfo, errors.New("flapping"))
+	e, _ = sup.GetState().ErrorDetail("link")
+	assert.Equal(t, SeverityInfo, e.Severity)
+	assert.True(t, sup.GetState().HasErrorsAtLeast(SeverityInfo))
+	code, _ = health(sup, "?severity=error")
+	assert.Equal(t, http.StatusOK, code)
+
+	data, err := json.Marshal(sup.GetState())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"severity":"warn"`)
+}
+
+func TestSupervisor_AckAndSilenceAlert(t *testing.T) {
+	var notified []bool
+	sup := NewSupervisor("test", WithAlertNotifier(func(id string, a *Alert, active bool) {
+		notified = append(notified, active)
+	}))
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	post := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+	code, _ := post("/alerts/temp/ack")
+	assert.Equal(t, http.StatusConflict, code, "inactive alert cannot be acked")
+	code, _ = post("/alerts/other/ack")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	sup.state.With().Set("temp", 90.0).Apply()
+	code, body := post("/alerts/temp/ack")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"acked":true`)
+	data, err := json.Marshal(sup.GetState())
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"acked":true`)
+	sup.state.With().Set("temp", 20.0).Apply()
+	assert.Equal(t, []bool{true}, notified, "clearing an acked alert is not notified")
+	info, _ := sup.Alert("temp")
+	assert.False(t, info.Acked, "acknowledgement ends when the alert clears")
+
+	code, _ = post("/alerts/temp/silence?duration=bogus")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = post("/alerts/temp/silence?duration=1h")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"silencedUntil"`)
+	sup.state.With().Set("temp", 90.0).Apply()
+	sup.state.With().Set("temp", 20.0).Apply()
+	assert.Equal(t, []bool{true}, notified, "silenced alert is not notified")
+	assert.False(t, sup.AlertActive("temp"), "silenced alert is still evaluated")
+
+	assert.True(t, sup.SilenceAlert("temp", 0))
+	sup.state.With().Set("temp", 90.0).Apply()
+	assert.Equal(t, []bool{true, true}, notified)
+	assert.False(t, sup.SilenceAlert("other", time.Hour))
+}
+
+func TestSupervisor_SilenceAlertClock(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	var notified []bool
+	sup := NewSupervisor("test", WithClock(clock), WithAlertNotifier(func(id string, a *Alert, active bool) {
+		notified = append(notified, active)
+	}))
+	sup.AddAlert("temp", NewMaxFloatAlert(80, AlertStrategyClear))
+	require.True(t, sup.SilenceAlert("temp", time.Hour))
+	info, _ := sup.Alert("temp")
+	require.NotNil(t, info.SilencedUntil)
+	assert.Equal(t, clock.Now().Add(time.Hour), *info.SilencedUntil)
+	sup.state.With().Set("temp", 90.0).Apply()
+	assert.Empty(t, notified)
+	for _, v := range []interface{}{sup.state.alerts["temp"], sup.state.alerts, sup.GetState()} {
+		out, err := json.Marshal(v)
+		require.NoError(t, err)
+		assert.Contains(t, string(out), `"silencedUntil":"2024-01-01T01:00:00Z"`, "%T renders the silence following the clock", v)
+	}
+
+	clock.skip(2 * time.Hour)
+	info, _ = sup.Alert("temp")
+	assert.Nil(t, info.SilencedUntil, "silence ends following the clock")
+	out, err := json.Marshal(sup.state.alerts)
+	require.NoError(t, err)
+	assert.NotContains(t, string(out), "silencedUntil")
+	sup.state.With().Set("temp", 20.0).Apply()
+	assert.Equal(t, []bool{false}, notified)
+}
+
+func TestSupervisor_RecoverPanics(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddProbe("bad", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		panic("boom")
+	}))
+	sup.AddProbe("good", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("good", true)
+	}))
+	var notified bool
+	sup.AddListener(func(*State) {
+		panic("boom")
+	})
+	sup.AddListener(func(*State) {
+		notified = true
+	})
+	require.NotPanics(t, func() {
+		sup.tick(context.Background(), time.Now())
+	})
+	assert.True(t, sup.GetState().Bool("good"))
+	assert.EqualError(t, sup.GetState().Err("bad"), "probe bad panicked: boom")
+	assert.True(t, notified, "listeners after the panicking one should be notified")
+}
+
+func TestSupervisor_WithLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := zerolog.New(&out)
+	sup := NewSupervisor("test", WithLogger(&logger))
+	sup.AddProbe("bad", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		panic("boom")
+	}))
+	sup.AddListener(func(*State) {
+		panic("boom")
+	})
+	sup.tick(context.Background(), time.Now())
+	assert.Contains(t, out.String(), `"metric":"bad","message":"probe panicked"`)
+	assert.Contains(t, out.String(), `"message":"listener panicked"`)
+}
+
+func TestSupervisor_MetricStatus(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddProbe("ok", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("ok", 1)
+	}))
+	sup.AddProbe("partial", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("partial.read", 1)
+		mutation.SetError("partial", errors.New("write check failed"))
+	}))
+	sup.AddProbe("down", 0, ErrProbeFunc(func(ctx context.Context) (map[string]interface{}, error) {
+		return nil, errors.New("connection refused")
+	}))
+	sup.AddProbe("idle", time.Hour, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {}))
+	for _, info := range sup.MetricInfo() {
+		assert.Empty(t, info.Status, info.Name)
+	}
+	sup.tick(context.Background(), time.Now().Add(2*time.Hour))
+
+	statuses := make(map[string]MetricStatus)
+	for _, info := range sup.MetricInfo() {
+		statuses[info.Name] = info.Status
+	}
+	assert.Equal(t, map[string]MetricStatus{
+		"ok":      MetricHealthy,
+		"partial": MetricDegraded,
+		"down":    MetricFailed,
+		"idle":    MetricHealthy,
+	}, statuses)
+
+	rec := httptest.NewRecorder()
+	sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probes", nil))
+	assert.Contains(t, rec.Body.String(), `"name":"down"`)
+	assert.Contains(t, rec.Body.String(), `"status":"failed"`)
+}
+
+func TestSupervisor_ExternalMetric(t *testing.T) {
+	sup := NewSupervisor("test")
+	sup.AddProbe("events", time.Second, nil)
+	sup.Push("events", 3)
+	sup.tick(context.Background(), time.Now())
+	sup.SampleNow(context.Background())
+
+	assert.Equal(t, 3, sup.GetState().Int("events"))
+	assert.Zero(t, sup.Stats().ProbesRun)
+	info := sup.MetricInfo()
+	require.Len(t, info, 1)
+	assert.Equal(t, "events", info[0].Name)
+	assert.True(t, info[0].LastUpdate.IsZero())
+}
+
+func TestSupervisor_MetricInfo(t *testing.T) {
+	sup := NewSupervisor("test")
+	probe := ProbeFunc(func(ctx context.Context, mutation *StateMutation) {})
+	sup.AddProbe("b", time.Second, probe)
+	sup.AddProbe("a", time.Hour, probe)
+	now := time.Now()
+	sup.tick(context.Background(), now)
+	sup.tick(context.Background(), now.Add(2*time.Second))
+
+	info := sup.MetricInfo()
+	require.Len(t, info, 2)
+	assert.Equal(t, MetricInfo{Name: "a", Interval: time.Hour, LastUpdate: now, Status: MetricHealthy}, info[0])
+	assert.Equal(t, MetricInfo{Name: "b", Interval: time.Second, LastUpdate: now.Add(2 * time.Second), Status: MetricHealthy}, info[1])
+
+	rec := httptest.NewRecorder()
+	sup.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/probes", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `{"name":"a","interval":3600000000000,"lastUpdate":`)
+}
+
+func TestSupervisor_RestoreOnStart(t *testing.T) {
+	store := NewMemStore()
+	require.NoError(t, store.Save(context.Background(), storeBucket, "test", map[string]interface{}{
+		"count": json.Number("42"), "ratio": json.Number("0.5"), "big": int64(7), "temp": 20.0, "name": "rpi",
+		"error.net": 1,
+	}, nil))
+	sup := NewSupervisor("test", WithStore(store), WithPersistedErrors(), WithRestoreOnStart())
+	assert.Equal(t, map[string]interface{}{"count": 42, "ratio": 0.5, "big": 7, "temp": 20.0, "name": "rpi"}, sup.state.Snapshot())
+	assert.Equal(t, 42, sup.GetState().Int("count"))
+}
+
+func TestSupervisor_LastShutdownClean(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store))
+	sup.tick(context.Background(), time.Now())
+	require.NoError(t, sup.Stop(context.Background()))
+
+	restarted := NewSupervisor("test", WithStore(store))
+	require.NoError(t, restarted.Restore(context.Background()))
+	clean, at := restarted.LastShutdownClean()
+	assert.True(t, clean)
+	assert.False(t, at.IsZero())
+
+	// crash after restart
+	restarted.tick(context.Background(), time.Now())
+	crashed := NewSupervisor("test", WithStore(store))
+	require.NoError(t, crashed.Restore(context.Background()))
+	clean, _ = crashed.LastShutdownClean()
+	assert.False(t, clean)
+
+	// no marker at all
+	fresh := NewSupervisor("other", WithStore(store))
+	require.NoError(t, fresh.Restore(context.Background()))
+	clean, at = fresh.LastShutdownClean()
+	assert.False(t, clean)
+	assert.True(t, at.IsZero())
+
+	assert.Equal(t, ErrNoReader, NewSupervisor("test", WithStore(writerFunc(nil))).Restore(context.Background()))
+}
+
+func TestMetric_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	stuck := ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		// ignores context cancellation
+		<-release
+		mutation.Set("health", true)
+	})
+	state := &State{data: map[string]interface{}{}}
+	mutation := state.With()
+	// returns although the probe never does
+	NewMetric("health", 0, stuck, Timeout(10*time.Millisecond)).updateState(context.Background(), mutation)
+	mutation.Apply()
+	assert.True(t, errors.Is(state.Err("health"), context.DeadlineExceeded))
+	assert.Nil(t, state.Elem("health"))
+}
+
+// BenchmarkSupervisor_TickSlowProbes measures tick latency with probes doing I/O;
+// sampling them one after another would take 10 times the latency of a single probe.
+func BenchmarkSupervisor_TickSlowProbes(b *testing.B) {
+	sup := NewSupervisor("bench")
+	for i := 0; i < 10; i++ {
+		sup.AddProbe(fmt.Sprintf("slow%d", i), 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+			time.Sleep(5 * time.Millisecond)
+		}))
+	}
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now = now.Add(time.Second)
+		sup.tick(context.Background(), now)
+	}
+}
+
+type writerFunc func(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error
+
+func (f writerFunc) Save(ctx context.Context, bucket, name string, fields map[string]interface{}, tags map[string]string) error {
+	return f(ctx, bucket, name, fields, tags)
 }
 
 type probeMock struct {
@@ -39,9 +1864,485 @@ type probeMock struct {
 }
 
 func (m *probeMock) UpdateState(ctx context.Context, state *StateMutation) {
-
+	args := m.MethodCalled("Read")
+	if err := args.Error(1); err != nil {
+		state.SetError("p1", err)
+		return
+	}
+	state.Set("p1", args.Int(0))
 }
 
 func (m *probeMock) SetupState(ctx context.Context, state *State) {
 
 }
+
+func TestSupervisor_MetricNames(t *testing.T) {
+	sup := NewSupervisor("test")
+	assert.Empty(t, sup.MetricNames())
+	sup.AddProbe("uptime", time.Minute, ProbeFunc(func(context.Context, *StateMutation) {}))
+	sup.AddProbe("load", 0, ProbeFunc(func(context.Context, *StateMutation) {}))
+	assert.Equal(t, []string{"load", "uptime"}, sup.MetricNames())
+	interval, found := sup.Interval("uptime")
+	assert.True(t, found)
+	assert.Equal(t, time.Minute, interval)
+	_, found = sup.Interval("missing")
+	assert.False(t, found)
+}
+
+func TestSupervisor_SampleNow(t *testing.T) {
+	var calls int32
+	sup := NewSupervisor("test")
+	sup.AddProbe("calls", time.Hour, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.Set("calls", int(atomic.AddInt32(&calls, 1)))
+	}))
+	now := time.Now()
+	sup.tick(context.Background(), now.Add(time.Second))
+	sup.tick(context.Background(), now.Add(2*time.Second))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	sup.SampleNow(context.Background())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	assert.Equal(t, 2, sup.GetState().Int("calls"))
+}
+
+func TestSupervisor_AddProbeNow(t *testing.T) {
+	var calls, others int32
+	sup := NewSupervisor("test")
+	sup.AddProbe("other", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		atomic.AddInt32(&others, 1)
+	}))
+	var notified int
+	sup.AddListener(func(*State) { notified++ })
+	start := time.Now()
+	sup.AddProbeNow(context.Background(), "calls", time.Minute, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.Set("calls", int(atomic.AddInt32(&calls, 1)))
+	}))
+	assert.Equal(t, 1, sup.GetState().Int("calls"), "value is available right away")
+	assert.Equal(t, 1, notified)
+	assert.Zero(t, atomic.LoadInt32(&others), "other probes are not sampled")
+
+	// the loop takes the immediate sample into account
+	sup.tick(context.Background(), start.Add(time.Second))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&others))
+	sup.tick(context.Background(), start.Add(time.Minute+time.Second))
+	assert.Equal(t, 2, sup.GetState().Int("calls"))
+}
+
+func TestSupervisor_AddDerived(t *testing.T) {
+	store := NewMemStore()
+	sup := NewSupervisor("test", WithStore(store))
+	var requests int32
+	sup.AddProbe("requests", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.SetInt("requests", int(atomic.AddInt32(&requests, 10)))
+	}))
+	sup.AddDerived("errorRate", func(st *State) interface{} {
+		return float64(st.Elem("errors").(int)) / float64(st.Int("requests"))
+	})
+	sup.AddDerived("requestsDoubled", func(st *State) interface{} {
+		requests, err := st.GetInt("requests")
+		if err != nil {
+			return nil
+		}
+		return 2 * requests
+	})
+	var keys []string
+	sup.AddKeysListener(func(_ *State, changed []string) {
+		keys = changed
+	})
+	now := time.Now()
+	sup.tick(context.Background(), now)
+	st := sup.GetState()
+	assert.Equal(t, 20, st.Int("requestsDoubled"), "derived metrics run after probes")
+	assert.Nil(t, st.Elem("errorRate"))
+	assert.Error(t, st.Err("errorRate"), "missing dependency is reported")
+
+	sup.Push("errors", 5)
+	sup.tick(context.Background(), now.Add(time.Second))
+	assert.Equal(t, 0.25, st.Float("errorRate"))
+	assert.NoError(t, st.Err("errorRate"))
+	assert.Equal(t, []string{"errorRate", "requests", "requestsDoubled"}, keys)
+	points := store.Points()
+	require.NotEmpty(t, points)
+	assert.Equal(t, 0.25, points[len(points)-1].Fields["errorRate"], "derived metrics are persisted")
+}
+
+func TestSupervisor_TickBudget(t *testing.T) {
+	sup := NewSupervisor("test", WithTickBudget(20*time.Millisecond))
+	release := make(chan struct{})
+	var calls int32
+	sup.AddProbe("wedged", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		m.Set("wedged", true).SetError("wedged", nil)
+	}))
+	sup.AddProbe("count", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.IncrInt("count", 1)
+	}))
+	st := sup.SampleNow(context.Background())
+	assert.Equal(t, 1, st.Int("count"))
+	assert.Error(t, st.Err("wedged"))
+	assert.Equal(t, MetricFailed, sup.MetricInfo()[1].Status)
+
+	// management calls and further passes are not blocked by the wedged probe which is not restarted
+	sup.AddAlert("count", NewMaxFloatAlert(10, AlertStrategyClear))
+	st = sup.SampleNow(context.Background())
+	assert.Equal(t, 2, st.Int("count"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		sup.mx.Lock()
+		defer sup.mx.Unlock()
+		return !sup.stalled["wedged"]
+	}, time.Second, time.Millisecond)
+	st = sup.SampleNow(context.Background())
+	assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	assert.True(t, st.Bool("wedged"))
+	assert.NoError(t, st.Err("wedged"))
+}
+
+func TestSupervisor_TickBudgetSkipsLevels(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock), WithTickBudget(20*time.Millisecond))
+	release := make(chan struct{})
+	defer close(release)
+	var wedge int32 = 1
+	sup.AddProbe("wedged", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		if atomic.CompareAndSwapInt32(&wedge, 1, 0) {
+			<-release
+		}
+	}))
+	sup.AddProbe("uptime", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.Set("uptime", 1)
+	}))
+	require.NoError(t, sup.AddProbeAfter("report", []string{"uptime"}, time.Minute, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.IncrInt("reports", 1)
+	})))
+	sup.tick(context.Background(), clock.Now())
+	assert.Equal(t, 0, sup.GetState().Int("reports"), "budget is spent by the wedged probe")
+	info := sup.MetricInfo()
+	require.Equal(t, "report", info[0].Name)
+	assert.Equal(t, MetricSkipped, info[0].Status)
+	assert.True(t, info[0].LastUpdate.IsZero(), "skipped probes are not counted as sampled")
+
+	// the wedged probe is left out so the skipped one runs in the next pass not waiting for its interval
+	clock.skip(time.Second)
+	sup.tick(context.Background(), clock.Now())
+	assert.Equal(t, 1, sup.GetState().Int("reports"))
+	assert.Equal(t, MetricHealthy, sup.MetricInfo()[0].Status)
+}
+
+func TestSupervisor_SampleNowConcurrentWithTicks(t *testing.T) {
+	sup := NewSupervisor("test", WithSamplingInterval(time.Millisecond))
+	sup.AddProbe("count", 0, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.IncrInt("count", 1)
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sup.Run(ctx)
+	prev := 0
+	for i := 0; i < 20; i++ {
+		count, _ := Get[int](sup.SampleNow(context.Background()), "count")
+		assert.Greater(t, count, prev)
+		prev = count
+	}
+	require.NoError(t, sup.Stop(context.Background()))
+}
+
+func TestSupervisor_AddProbeGroup(t *testing.T) {
+	sup := NewSupervisor("test")
+	var order []string
+	member := func(name string, err error) Probe {
+		return ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+			order = append(order, name)
+			mutation.Set(name, len(order))
+			mutation.SetError(name, err)
+		})
+	}
+	sup.AddProbeGroup("db", time.Minute, map[string]Probe{
+		"db.replica": member("db.replica", errors.New("lagging")),
+		"db.primary": member("db.primary", nil),
+		"db.broken": ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+			panic("boom")
+		}),
+	})
+	sup.tick(context.Background(), time.Now())
+
+	assert.Equal(t, []string{"db.primary", "db.replica"}, order)
+	state := sup.GetState()
+	assert.Equal(t, 1, state.Int("db.primary"))
+	assert.Equal(t, 2, state.Int("db.replica"))
+	assert.NoError(t, state.Err("db.primary"))
+	assert.EqualError(t, state.Err("db.replica"), "lagging")
+	assert.EqualError(t, state.Err("db.broken"), "probe db.broken panicked: boom")
+	info := sup.MetricInfo()
+	require.Len(t, info, 1)
+	assert.Equal(t, "db", info[0].Name)
+}
+
+func TestSupervisor_AddProbeAfter(t *testing.T) {
+	sup := NewSupervisor("test")
+	var tick int
+	raw := func(name string) ProbeFunc {
+		return func(ctx context.Context, mutation *StateMutation) {
+			mutation.Set(name, tick)
+		}
+	}
+	require.NoError(t, sup.AddProbeAfter("score", []string{"cpu", "mem"}, 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("score", sup.GetState().Int("cpu")+sup.GetState().Int("mem"))
+	})))
+	require.NoError(t, sup.AddProbeAfter("report", []string{"score"}, 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("report", fmt.Sprintf("score %d", sup.GetState().Int("score")))
+	})))
+	sup.AddProbe("cpu", 0, raw("cpu"))
+	sup.AddProbe("mem", 0, raw("mem"))
+	var notified int
+	sup.AddListener(func(*State) {
+		notified++
+	})
+	now := time.Now()
+	for tick = 1; tick <= 5; tick++ {
+		sup.tick(context.Background(), now.Add(time.Duration(tick)*time.Second))
+		assert.Equal(t, 2*tick, sup.GetState().Int("score"))
+		assert.Equal(t, fmt.Sprintf("score %d", 2*tick), sup.GetState().String("report"))
+	}
+	assert.Equal(t, 5, notified, "listeners should be notified once per tick")
+
+	err := sup.AddProbeAfter("cpu", []string{"report"}, 0, raw("cpu"))
+	assert.True(t, errors.Is(err, ErrDependencyCycle), err)
+	assert.True(t, errors.Is(sup.AddProbeAfter("self", []string{"self"}, 0, raw("self")), ErrDependencyCycle))
+	assert.NoError(t, sup.AddProbeAfter("cpu", []string{"uptime"}, 0, raw("cpu")))
+}
+
+type manualClock struct {
+	mx     sync.Mutex
+	now    time.Time
+	ticker chan time.Time
+	// intervals receives the interval of every ticker created if set
+	intervals chan time.Duration
+	timers    []*manualTimer
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *manualClock) NewTicker(d time.Duration) Ticker {
+	if c.intervals != nil {
+		c.intervals <- d
+	}
+	return manualTicker(c.ticker)
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	t := &manualTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the clock and delivers a tick; it returns once the sampling loop has received it
+func (c *manualClock) advance(d time.Duration) {
+	c.skip(d)
+	c.ticker <- c.Now()
+}
+
+// skip moves the clock without delivering a tick; timers due by then are fired before it returns
+func (c *manualClock) skip(d time.Duration) {
+	c.mx.Lock()
+	c.now = c.now.Add(d)
+	var due []*manualTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.mx.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+type manualTimer struct {
+	clock *manualClock
+	at    time.Time
+	f     func()
+}
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mx.Lock()
+	defer t.clock.mx.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type manualTicker chan time.Time
+
+func (t manualTicker) C() <-chan time.Time {
+	return t
+}
+
+func (t manualTicker) Stop() {}
+
+func TestSupervisor_AdaptiveSampling(t *testing.T) {
+	sup := NewSupervisor("test", WithAdaptiveSampling(50*time.Millisecond))
+	var calls int32
+	sup.AddProbe("fast", 200*time.Millisecond, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	sup.AddProbe("slow", time.Minute, ProbeFunc(func(_ context.Context, m *StateMutation) {}))
+	sup.mx.Lock()
+	assert.Equal(t, 200*time.Millisecond, sup.tickInterval())
+	sup.mx.Unlock()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		// ticks may arrive slightly early
+		sup.tick(context.Background(), now.Add(time.Duration(i)*200*time.Millisecond-time.Millisecond))
+	}
+	assert.EqualValues(t, 5, atomic.LoadInt32(&calls))
+
+	sup.AddProbe("faster", time.Millisecond, ProbeFunc(func(_ context.Context, m *StateMutation) {}))
+	sup.mx.Lock()
+	assert.Equal(t, 50*time.Millisecond, sup.tickInterval(), "tick is clamped")
+	sup.mx.Unlock()
+
+	// the loop ticks at the derived interval
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time), intervals: make(chan time.Duration, 1)}
+	sup = NewSupervisor("test", WithClock(clock), WithAdaptiveSampling(50*time.Millisecond))
+	atomic.StoreInt32(&calls, 0)
+	sup.AddProbe("fast", 200*time.Millisecond, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	sup.Run(context.Background())
+	assert.Equal(t, 200*time.Millisecond, <-clock.intervals)
+	for i := 0; i < 5; i++ {
+		clock.advance(200 * time.Millisecond)
+	}
+	sup.AddProbe("faster", time.Millisecond, ProbeFunc(func(_ context.Context, m *StateMutation) {}))
+	assert.Equal(t, 50*time.Millisecond, <-clock.intervals, "the loop picks up the tick of added probes")
+	require.NoError(t, sup.Stop(context.Background()))
+	assert.EqualValues(t, 5, atomic.LoadInt32(&calls))
+}
+
+func TestSupervisor_WithClock(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock))
+	var mx sync.Mutex
+	var fired []string
+	probe := func(name string) ProbeFunc {
+		return func(ctx context.Context, mutation *StateMutation) {
+			mx.Lock()
+			// ticks are counted once sampling is done
+			fired = append(fired, fmt.Sprintf("%s@%d", name, sup.Stats().Ticks+1))
+			mx.Unlock()
+		}
+	}
+	sup.AddProbe("fast", 0, probe("fast"))
+	sup.AddProbe("slow", 2*time.Second, probe("slow"))
+	sup.Run(context.Background())
+	for i := 0; i < 4; i++ {
+		clock.advance(time.Second)
+	}
+	require.NoError(t, sup.Stop(context.Background()))
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.ElementsMatch(t, []string{"fast@1", "slow@1", "fast@2", "fast@3", "fast@4", "slow@3"}, fired)
+	assert.Equal(t, 4*time.Second, sup.Stats().Uptime)
+	assert.Equal(t, clock.Now(), sup.Stats().LastTick)
+}
+
+func TestSupervisor_TickPanicRecovery(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), ticker: make(chan time.Time)}
+	sup := NewSupervisor("test", WithClock(clock))
+	var calls int32
+	sup.AddProbe("counter", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("count", int(atomic.AddInt32(&calls, 1)))
+	}))
+	sup.AddAlert("count", &Alert{update: func(val interface{}, a *Alert) {
+		if val.(int) < 3 {
+			panic("boom")
+		}
+	}})
+	sup.Run(context.Background())
+	clock.advance(time.Second)
+	clock.advance(time.Second)
+	// the loop has received the tick once the previous pass is over
+	clock.advance(time.Second)
+	require.NoError(t, sup.Stop(context.Background()))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls), "loop keeps ticking after a panic")
+	assert.EqualValues(t, 1, sup.Stats().Ticks)
+	_, found := sup.state.ErrorDetail(TickErrorCode)
+	assert.False(t, found, "error is resolved by the next complete pass")
+
+	sup = NewSupervisor("test")
+	sup.AddProbe("counter", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set("count", 1)
+	}))
+	sup.AddAlert("count", &Alert{update: func(val interface{}, a *Alert) { panic("boom") }})
+	sup.tick(context.Background(), time.Now())
+	err, found := sup.state.ErrorDetail(TickErrorCode)
+	require.True(t, found)
+	assert.Equal(t, "sampling pass panicked in alert phase: boom", err.Error())
+	assert.Equal(t, SeverityCritical, err.Severity)
+	sup.tick(context.Background(), time.Now().Add(time.Second))
+	err, _ = sup.state.ErrorDetail(TickErrorCode)
+	assert.Equal(t, 2, err.Count)
+}
+
+func TestSupervisor_AsyncListeners(t *testing.T) {
+	sup := NewSupervisor("test", WithAsyncListeners(1))
+	var value int32
+	sup.AddProbe("value", 0, ProbeFunc(func(ctx context.Context, mutation *StateMutation) {
+		mutation.Set(fmt.Sprintf("key%d", atomic.AddInt32(&value, 1)), true)
+	}))
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	slow := make(chan []string, 10)
+	sup.AddKeysListener(func(current *State, keys []string) {
+		started <- struct{}{}
+		<-release
+		slow <- keys
+	})
+	fast := make(chan []string, 10)
+	sup.AddKeysListener(func(current *State, keys []string) {
+		fast <- keys
+	})
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		sup.tick(context.Background(), now.Add(time.Duration(i)*time.Second))
+		select {
+		case <-fast:
+		case <-time.After(time.Second):
+			require.Fail(t, "fast listener should not be delayed by the slow one")
+		}
+		if i == 0 {
+			<-started
+		}
+	}
+	close(release)
+	var received [][]string
+	for len(received) < 2 {
+		select {
+		case keys := <-slow:
+			received = append(received, keys)
+		case <-time.After(time.Second):
+			require.Fail(t, "slow listener should catch up")
+		}
+	}
+	// the first update is taken right away, the second and the third one are dropped
+	assert.Equal(t, [][]string{{"key1"}, {"key2", "key3", "key4"}}, received)
+	assert.Equal(t, map[string]uint64{"listener.1": 2, "listener.2": 0}, sup.Stats().DroppedUpdates)
+}
@@ -0,0 +1,88 @@
+package gockpit
+
+import (
+	"context"
+	"net/http"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+const (
+	// CmdSample forces an immediate sampling pass
+	CmdSample = "sample"
+	// CmdAck acknowledges an active alert suppressing its notifications until it clears
+	CmdAck = "ack"
+)
+
+// ControlCommand is a message accepted by the state websocket.
+type ControlCommand struct {
+	Cmd   string `json:"cmd"`
+	Alert string `json:"alert,omitempty"`
+}
+
+// handlerStateSocket streams the state over a websocket like handlerStateStream
+// and executes control commands sent by the peer. Cross origin connections are rejected
+// unless allowed with WithWebsocketOrigins.
+func (s *Supervisor) handlerStateSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: s.wsOrigins,
+	})
+	if err != nil {
+		// Accept has already written the error response
+		s.logger.Warn().Err(err).Str("peer", r.RemoteAddr).Msg("could not accept websocket connection")
+		return
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	updates := make(chan struct{}, 1)
+	unsubscribe := s.AddListener(func(*State) {
+		select {
+		case updates <- struct{}{}:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	go func() {
+		defer cancel()
+		for {
+			var cmd ControlCommand
+			if err := wsjson.Read(ctx, ws, &cmd); err != nil {
+				return
+			}
+			s.control(ctx, r.RemoteAddr, cmd)
+		}
+	}()
+
+	for {
+		data, err := s.marshalState()
+		if err != nil {
+			s.logger.Error().Err(err).Msg("could not marshal state")
+			return
+		}
+		if err = ws.Write(ctx, websocket.MessageText, data); err != nil {
+			return
+		}
+		select {
+		case <-updates:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Supervisor) control(ctx context.Context, peer string, cmd ControlCommand) {
+	switch cmd.Cmd {
+	case CmdSample:
+		s.SampleNow(ctx)
+	case CmdAck:
+		if !s.AckAlert(cmd.Alert) {
+			s.logger.Warn().Str("peer", peer).Str("alert", cmd.Alert).Msg("could not acknowledge alert; alert is not active")
+		}
+	default:
+		s.logger.Warn().Str("peer", peer).Str("cmd", cmd.Cmd).Msg("unknown control command")
+	}
+}
@@ -0,0 +1,79 @@
+package gockpit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestSupervisor_HandlerStateSocket(t *testing.T) {
+	var temp int64 = 20
+	var notified int32
+	sup := NewSupervisor("test", WithAlertNotifier(func(string, *Alert, bool) {
+		atomic.AddInt32(&notified, 1)
+	}))
+	sup.AddProbe("temp", time.Hour, ProbeFunc(func(_ context.Context, m *StateMutation) {
+		m.Set("temp", int(atomic.LoadInt64(&temp)))
+	}))
+	sup.AddAlert("hot", NewThresholdAlert("temp", OpGreater, 10, AlertStrategyClear))
+	sup.SampleNow(context.Background())
+	require.True(t, sup.AlertActive("hot"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&notified))
+
+	srv := httptest.NewServer(sup.HTTPHandler())
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/state/ws", nil)
+	require.NoError(t, err)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	readState := func() map[string]interface{} {
+		var msg struct {
+			State map[string]interface{} `json:"state"`
+		}
+		require.NoError(t, wsjson.Read(ctx, conn, &msg))
+		return msg.State
+	}
+	assert.EqualValues(t, 20, readState()["temp"])
+
+	// commands are executed in order so the alert is acked before sampling
+	require.NoError(t, wsjson.Write(ctx, conn, ControlCommand{Cmd: CmdAck, Alert: "hot"}))
+	atomic.StoreInt64(&temp, 5)
+	require.NoError(t, wsjson.Write(ctx, conn, ControlCommand{Cmd: CmdSample}))
+	assert.EqualValues(t, 5, readState()["temp"])
+	assert.False(t, sup.AlertActive("hot"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&notified), "clearing an acked alert must not be notified")
+}
+
+func TestSupervisor_HandlerStateSocketOrigin(t *testing.T) {
+	dial := func(srv *httptest.Server, origin string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/state/ws", &websocket.DialOptions{
+			HTTPHeader: http.Header{"Origin": []string{origin}},
+		})
+		if err == nil {
+			conn.Close(websocket.StatusNormalClosure, "")
+		}
+		return err
+	}
+	srv := httptest.NewServer(NewSupervisor("test").HTTPHandler())
+	defer srv.Close()
+	assert.NoError(t, dial(srv, srv.URL), "same origin connections are accepted")
+	assert.Error(t, dial(srv, "http://evil.example.com"), "cross origin connections must be rejected")
+
+	allowed := httptest.NewServer(NewSupervisor("test", WithWebsocketOrigins("*.example.com")).HTTPHandler())
+	defer allowed.Close()
+	assert.NoError(t, dial(allowed, "http://dashboard.example.com"))
+	assert.Error(t, dial(allowed, "http://example.org"))
+}